@@ -41,10 +41,10 @@ if $redo_benchmark; then
     echo "Running benchmark command..."
     go test -bench BenchmarkTrace -cpuprofile=temp/cpu.prof -benchtime=1x
 
-    # Remove the v0.test file if it exists
-    if [ -f "v0.test" ]; then
-        echo "Cleaning up temporary test binary (v0.test)..."
-        rm -f v0.test
+    # Remove the fugue-crdt.test file if it exists
+    if [ -f "fugue-crdt.test" ]; then
+        echo "Cleaning up temporary test binary (fugue-crdt.test)..."
+        rm -f fugue-crdt.test
     fi
 else
     echo "Skipping benchmark command as per user request."
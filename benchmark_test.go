@@ -1,13 +1,16 @@
-package main
+package fugue_test
 
 import (
 	"bufio"
 	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	fugue "github.com/seercle/fugue-crdt"
 )
 
 type Operation struct {
@@ -86,14 +89,14 @@ func BenchmarkTrace(b *testing.B) {
 		b.Fatalf("Failed to create benchmark file: %v", err)
 	}
 	defer file.Close()
-	doc := newDoc()
+	doc := fugue.NewDocWithClient(0)
 	var time_sum time.Duration
 	for i, op := range operations {
 		start := time.Now()
 		if op.Type {
-			err = doc.localDelete(op.Position, 1)
+			err = doc.Delete(op.Position, 1)
 		} else {
-			err = doc.localInsert(Client(0), op.Position, Content(op.String))
+			err = doc.Insert(op.Position, op.String)
 		}
 		if err != nil {
 			b.Fatalf("Failed to apply operation: %v", err)
@@ -108,3 +111,18 @@ func BenchmarkTrace(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkObservedInsert measures a mid-document insert on a large document with an observer,
+// whose delta must not scan the whole document
+func BenchmarkObservedInsert(b *testing.B) {
+	doc := fugue.NewDocWithClient(0)
+	rng := rand.New(rand.NewSource(0))
+	for i := range 20000 {
+		doc.Insert(rng.Intn(i+1), "a")
+	}
+	doc.Observe(func(event fugue.Event) {})
+	b.ResetTimer()
+	for range b.N {
+		doc.Insert(doc.Len()/2, "b")
+	}
+}
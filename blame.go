@@ -0,0 +1,56 @@
+package fugue
+
+import "fmt"
+
+// Authorship is a run of visible characters inserted by the same client
+type Authorship struct {
+	Position int    `json:"position"` // position of the run, in the unit of the document
+	Length   int    `json:"length"`   // length of the run, in the unit of the document
+	Client   Client `json:"client"`   // client that inserted the characters
+}
+
+// Blame returns the clients that inserted the visible characters of the given range, in runs of consecutive
+// characters of the same client, with positions and lengths counted in the unit of the document
+//
+// Deleted characters are not in the visible text, see Changes for the clients that deleted them.
+// returns an error if the length is negative
+// returns an error if the range is out of bounds or starts or ends inside a character
+func (doc *Doc) Blame(position int, length int) ([]Authorship, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("length must not be negative")
+	}
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	start, err := doc.toRunes(position)
+	if err != nil {
+		return nil, err
+	}
+	end, err := doc.toRunes(position + length)
+	if err != nil {
+		return nil, err
+	}
+	var runs []Authorship
+	doc.visibleRange(start, end, func(linked_item *linkedItem, content Content) {
+		run_length := doc.unitLength(content)
+		if last := len(runs) - 1; last >= 0 && runs[last].Client == linked_item.item.id.client {
+			runs[last].Length += run_length
+		} else {
+			runs = append(runs, Authorship{Position: position, Length: run_length, Client: linked_item.item.id.client})
+		}
+		position += run_length
+	})
+	return runs, nil
+}
+
+// Contributions counts the visible characters inserted by every client, in the unit of the document
+func (doc *Doc) Contributions() map[Client]int {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	contributions := make(map[Client]int)
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		if !linked_item.item.deleted {
+			contributions[linked_item.item.id.client] += linked_item.counts[doc.unit]
+		}
+	}
+	return contributions
+}
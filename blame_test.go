@@ -0,0 +1,50 @@
+package fugue
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestBlame(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello world")
+	syncDocs(t, doc1, doc2)
+	doc2.Insert(5, ", dear")
+	doc2.Delete(12, 6)
+	doc2.Insert(12, "😀")
+	syncDocs(t, doc2, doc1)
+	if doc1.Text() != "Hello, dear 😀" {
+		t.Fatalf("Unexpected content: '%s'", doc1.Text())
+	}
+	runs, err := doc1.Blame(0, doc1.Len())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []Authorship{{Position: 0, Length: 5, Client: 1}, {Position: 5, Length: 6, Client: 2}, {Position: 11, Length: 1, Client: 1}, {Position: 12, Length: 1, Client: 2}}
+	if !slices.Equal(runs, expected) {
+		t.Errorf("Unexpected runs: %v, expected %v", runs, expected)
+	}
+	// Ranges and contributions are counted in the unit of the document
+	doc1.SetUnit(UnitUTF16)
+	runs, err = doc1.Blame(3, 11)
+	expected = []Authorship{{Position: 3, Length: 2, Client: 1}, {Position: 5, Length: 6, Client: 2}, {Position: 11, Length: 1, Client: 1}, {Position: 12, Length: 2, Client: 2}}
+	if err != nil || !slices.Equal(runs, expected) {
+		t.Errorf("Unexpected runs: %v %v, expected %v", runs, err, expected)
+	}
+	if contributions := doc1.Contributions(); !maps.Equal(contributions, map[Client]int{1: 6, 2: 8}) {
+		t.Errorf("Unexpected contributions: %v", contributions)
+	}
+	if _, err := doc1.Blame(13, 1); !errors.Is(err, ErrInsideCharacter) {
+		t.Errorf("Unexpected error inside a character: %v", err)
+	}
+	// An empty range has no runs, even inside an item
+	if runs, err := doc1.Blame(1, 0); err != nil || len(runs) != 0 {
+		t.Errorf("Unexpected runs of an empty range: %v %v", runs, err)
+	}
+	if _, err := doc1.Blame(5, -1); err == nil {
+		t.Errorf("Expected an error for a negative length")
+	}
+}
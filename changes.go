@@ -0,0 +1,136 @@
+package fugue
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Change is a run of characters inserted or deleted between two snapshots, only one of Insert and Delete is set
+//
+// InsertedBy is the client that inserted the characters, whether the change inserts or deletes them,
+// and DeletedBy the client that deleted them, for deletions only. Characters deleted concurrently
+// by several clients are attributed to the smallest of them, so that every replica agrees.
+// DeletedBy is nil for insertions, and for deletions received without the client that made them.
+type Change struct {
+	Position   int     `json:"position"`             // position of the change in the text of the later snapshot, in the unit of the document
+	Insert     string  `json:"insert,omitempty"`     // characters visible in the later snapshot only
+	Delete     string  `json:"delete,omitempty"`     // characters visible in the earlier snapshot only
+	InsertedBy Client  `json:"inserted_by"`          // client that inserted the characters
+	DeletedBy  *Client `json:"deleted_by,omitempty"` // client that deleted the characters, nil if unknown or for insertions
+}
+
+// Changes lists the characters inserted and deleted between two snapshots, in document order
+//
+// The items of the document are walked once, comparing the characters visible in both snapshots.
+// Consecutive characters of the same clients inserted or deleted together are grouped in one change.
+// returns ErrNotFound if a snapshot has items that are not in the document,
+// or ErrCollected if the GC dropped some of the characters of the changes
+func (doc *Doc) Changes(from Snapshot, to Snapshot) ([]Change, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	if err := doc.checkSnapshot(from); err != nil {
+		return nil, err
+	}
+	if err := doc.checkSnapshot(to); err != nil {
+		return nil, err
+	}
+	var changes []Change
+	position := 0
+	// Changes are only grouped if no retained character is between them
+	grouped := false
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		for _, item := range linked_item.items() {
+			before := from.visible(item)
+			after := to.visible(item)
+			if len(before) == 0 && len(after) == 0 {
+				continue
+			}
+			// Segments are also cut where the client deleting the characters changes
+			cuts := [][]seqRange{before, after}
+			for _, ds := range doc.deleted_by {
+				cuts = append(cuts, ds.intersect(item.id.client, item.id.seq, item.length))
+			}
+			for _, segment := range segmentRanges(item, cuts...) {
+				in_before := containsSeq(before, segment.start)
+				in_after := containsSeq(after, segment.start)
+				if item.collected() && in_before != in_after {
+					return nil, fmt.Errorf("%w: item %d:%d", ErrCollected, item.id.client, segment.start)
+				}
+				content := contentRange(item, segment.start, segment.length)
+				var change Change
+				switch {
+				case in_before && in_after:
+					position += doc.unitLength(content)
+					grouped = false
+					continue
+				case in_after:
+					change = Change{Position: position, Insert: string(content), InsertedBy: item.id.client}
+					position += doc.unitLength(content)
+				case in_before:
+					deleted_by := doc.deleted_by.deleter(Id{client: item.id.client, seq: segment.start})
+					change = Change{Position: position, Delete: string(content), InsertedBy: item.id.client, DeletedBy: deleted_by}
+				default:
+					continue
+				}
+				changes = appendChange(changes, change, grouped)
+				grouped = true
+			}
+		}
+	}
+	return changes, nil
+}
+
+// appendChange appends the change, merging it with the last change if they can be grouped,
+// have the same kind and were inserted and deleted by the same clients
+func appendChange(changes []Change, change Change, grouped bool) []Change {
+	if grouped && len(changes) > 0 {
+		last := &changes[len(changes)-1]
+		if last.InsertedBy == change.InsertedBy && sameClient(last.DeletedBy, change.DeletedBy) && (last.Insert == "") == (change.Insert == "") {
+			last.Insert += change.Insert
+			last.Delete += change.Delete
+			return changes
+		}
+	}
+	return append(changes, change)
+}
+
+// segmentRanges splits the ids of the item at the boundaries of the given ranges, which must be inside the item,
+// so that every segment is entirely inside or outside of each range
+func segmentRanges(item Item, range_lists ...[]seqRange) []seqRange {
+	cuts := []Seq{item.id.seq, item.id.seq + Seq(item.length)}
+	for _, ranges := range range_lists {
+		for _, r := range ranges {
+			cuts = append(cuts, r.start, r.end())
+		}
+	}
+	slices.Sort(cuts)
+	cuts = slices.Compact(cuts)
+	segments := make([]seqRange, 0, len(cuts)-1)
+	for i := 1; i < len(cuts); i++ {
+		segments = append(segments, seqRange{start: cuts[i-1], length: int(cuts[i] - cuts[i-1])})
+	}
+	return segments
+}
+
+// containsSeq checks if one of the ranges contains the seq
+func containsSeq(ranges []seqRange, seq Seq) bool {
+	return slices.ContainsFunc(ranges, func(r seqRange) bool { return r.start <= seq && seq < r.end() })
+}
+
+// sameClient checks if both clients are nil or equal
+func sameClient(a *Client, b *Client) bool {
+	return a == b || a != nil && b != nil && *a == *b
+}
+
+// deleter returns the client that deleted the id, the smallest one if several clients deleted it concurrently
+//
+// returns nil if no client is known to have deleted the id
+func (d deleters) deleter(id Id) *Client {
+	var deleter *Client
+	for by, ds := range d {
+		if ds.contains(id) && (deleter == nil || by < *deleter) {
+			deleter = &by
+		}
+	}
+	return deleter
+}
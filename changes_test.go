@@ -0,0 +1,215 @@
+package fugue
+
+import (
+	"encoding/json"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// revertChanges rebuilds the earlier text from the later text and the changes between them
+func revertChanges(t *testing.T, text string, changes []Change) string {
+	t.Helper()
+	runes := []rune(text)
+	var result []rune
+	position := 0
+	for _, change := range changes {
+		result = append(result, runes[position:change.Position]...)
+		position = change.Position
+		if change.Insert != "" {
+			inserted := []rune(change.Insert)
+			if string(runes[position:position+len(inserted)]) != change.Insert {
+				t.Fatalf("Inserted text '%s' not found at %d in '%s'", change.Insert, position, text)
+			}
+			position += len(inserted)
+		}
+		result = append(result, []rune(change.Delete)...)
+	}
+	return string(append(result, runes[position:]...))
+}
+
+// equalChanges checks if the changes are the same, comparing the clients that deleted them by value
+func equalChanges(a, b []Change) bool {
+	return slices.EqualFunc(a, b, func(x, y Change) bool {
+		return x.Position == y.Position && x.Insert == y.Insert && x.Delete == y.Delete &&
+			x.InsertedBy == y.InsertedBy && sameClient(x.DeletedBy, y.DeletedBy)
+	})
+}
+
+// clientRef returns a pointer to the client, for the DeletedBy of the expected changes
+func clientRef(client Client) *Client {
+	return &client
+}
+
+func TestChanges(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello world")
+	syncDocs(t, doc1, doc2)
+	from := doc1.Snapshot()
+	doc1.Delete(0, 1)
+	doc1.Insert(0, "J")
+	doc2.Insert(11, "!")
+	doc2.Delete(5, 6)
+	syncDocs(t, doc2, doc1)
+	to := doc1.Snapshot()
+	if doc1.Text() != "Jello!" {
+		t.Fatalf("Unexpected content: '%s'", doc1.Text())
+	}
+	changes, err := doc1.Changes(from, to)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []Change{
+		{Position: 0, Insert: "J", InsertedBy: 1},
+		{Position: 1, Delete: "H", InsertedBy: 1, DeletedBy: clientRef(1)},
+		{Position: 5, Delete: " world", InsertedBy: 1, DeletedBy: clientRef(2)},
+		{Position: 5, Insert: "!", InsertedBy: 2},
+	}
+	if !equalChanges(changes, expected) {
+		t.Errorf("Unexpected changes: %v, expected %v", changes, expected)
+	}
+	// The changes in the other direction swap insertions and deletions
+	changes, _ = doc1.Changes(to, from)
+	if revertChanges(t, "Hello world", changes) != "Jello!" {
+		t.Errorf("Unexpected reverse changes: %v", changes)
+	}
+	// Characters deleted concurrently are attributed to the smallest client
+	doc1.Delete(2, 2)
+	doc2.Delete(2, 3)
+	syncDocs(t, doc1, doc2)
+	syncDocs(t, doc2, doc1)
+	// The deleting clients are sent with the state of the document
+	doc3 := NewDocWithClient(3)
+	if err := doc3.ApplyUpdate(doc1.EncodeState()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	changes, err = doc3.Changes(to, doc1.Snapshot())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = []Change{{Position: 2, Delete: "ll", InsertedBy: 1, DeletedBy: clientRef(1)}, {Position: 2, Delete: "o", InsertedBy: 1, DeletedBy: clientRef(2)}}
+	if !equalChanges(changes, expected) {
+		t.Errorf("Unexpected changes: %v, expected %v", changes, expected)
+	}
+	// Deletions received without the clients that made them are not attributed
+	doc4 := NewDocWithClient(4)
+	doc5 := NewDocWithClient(5)
+	doc4.Insert(0, "abc")
+	syncDocs(t, doc4, doc5)
+	from = doc5.Snapshot()
+	doc4.Delete(1, 1)
+	data, err := UpdateToJSON(doc4.EncodeState())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var decoded map[string]json.RawMessage
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	delete(decoded, "deletions")
+	data, _ = json.Marshal(decoded)
+	unattributed, err := UpdateFromJSON(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := doc5.ApplyUpdate(unattributed); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	changes, err = doc5.Changes(from, doc5.Snapshot())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = []Change{{Position: 1, Delete: "b", InsertedBy: 4}}
+	if !equalChanges(changes, expected) {
+		t.Errorf("Unexpected changes: %v, expected %v", changes, expected)
+	}
+}
+
+func TestDeletions(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello world")
+	doc1.Delete(5, 6)
+	syncDocs(t, doc1, doc2)
+	// The deletion takes a seq, so a diff only carries the deletions the peer is missing
+	if version := doc1.Version(); version[1] != 11 {
+		t.Errorf("Unexpected version: %v", version)
+	}
+	deletions := func(data []byte) int {
+		t.Helper()
+		data, err := UpdateToJSON(data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var decoded jsonUpdate
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return len(decoded.Deletions)
+	}
+	diff, _ := doc1.EncodeDiff(doc2.EncodeStateVector())
+	if count := deletions(diff); count != 0 {
+		t.Errorf("Unexpected deletions in the diff: %d", count)
+	}
+	doc2.Delete(0, 1)
+	diff, _ = doc2.EncodeDiff(doc1.EncodeStateVector())
+	if count := deletions(diff); count != 1 {
+		t.Errorf("Unexpected deletions in the diff: %d", count)
+	}
+	syncDocs(t, doc2, doc1)
+	// The GC drops the collected ids from the deletions every replica has
+	if err := doc1.GC(MinVersion(doc1.Version(), doc2.Version())); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for id, d := range doc1.deletions {
+		if len(d.deleted) > 0 {
+			t.Errorf("Deletion %v not pruned: %v", id, d.deleted)
+		}
+	}
+	for by, ds := range doc1.deleted_by {
+		if len(ds) > 0 {
+			t.Errorf("Deletions of client %d not pruned: %v", by, ds)
+		}
+	}
+	// The pruned deletions are still sent, a replica loading the state has the same version
+	doc3 := NewDocWithClient(3)
+	if err := doc3.ApplyUpdate(doc1.EncodeState()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !maps.Equal(doc3.Version(), doc1.Version()) || doc3.Text() != "ello" {
+		t.Errorf("Unexpected state: %v '%s'", doc3.Version(), doc3.Text())
+	}
+}
+
+func TestChangesFuzzer(t *testing.T) {
+	const trials int64 = 50
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		var snapshots []Snapshot
+		for range 200 {
+			doc := docs[rng.Intn(len(docs))]
+			randomEdit(t, rng, doc)
+			if rng.Float32() < 0.3 {
+				syncDocs(t, doc, docs[rng.Intn(len(docs))])
+			}
+			if rng.Float32() < 0.1 {
+				snapshots = append(snapshots, docs[0].Snapshot())
+			}
+		}
+		for k := 1; k < len(snapshots); k++ {
+			from, to := snapshots[rng.Intn(k)], snapshots[k]
+			changes, err := docs[0].Changes(from, to)
+			if err != nil {
+				t.Fatalf("Trial %d: unexpected error: %v", i, err)
+			}
+			before, _ := docs[0].ContentAt(from)
+			after, _ := docs[0].ContentAt(to)
+			if reverted := revertChanges(t, after, changes); reverted != before {
+				t.Fatalf("Trial %d: reverted '%s', expected '%s'", i, reverted, before)
+			}
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package fugue
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"unicode/utf8"
+)
+
+// A container holds several documents addressed by name, its roots, such as the title and the body of an article.
+// The roots share the lock, the client and the version of the container, so every change of a root takes the next seq
+// of the client, and one state vector covers all the roots. Roots are created on first use, locally or by an update,
+// and the same root can be read as a text, a map or a sequence. A container update is made of an update per root,
+// and is applied to all the roots at once, so that the items of a root can wait for the seqs of another root.
+
+// Container is a replica of a set of collaborative texts, maps and sequences addressed by name,
+// synced together with one state vector and one update
+//
+// The roots of a container are synced with the container: their own EncodeDiff, ApplyUpdate, Merge and UnmarshalJSON
+// return ErrContainerRoot, and their EncodeState returns nil. A Container can be used by several goroutines at once
+type Container struct {
+	mu        *sync.RWMutex // shared with the roots
+	emit      *dispatcher   // shared with the roots
+	client    Client
+	version   Version // shared with the roots
+	roots     map[string]*containerRoot
+	observers []*containerObserver
+}
+
+// containerRoot is a root of a container
+type containerRoot struct {
+	doc      *Doc
+	sequence bool // whether the root is read as a sequence, whose updates must then be made of elements
+}
+
+// containerObserver is a function notified of the updates of every root of a container
+type containerObserver struct {
+	fn    func(update []byte, local bool)
+	roots map[string]*observer // observer registered on every root
+}
+
+// NewContainer creates an empty container whose local edits are made by a new random client
+func NewContainer() *Container {
+	return NewContainerWithClient(RandomClient())
+}
+
+// NewContainerWithClient creates an empty container whose local edits are made by the given client
+//
+// Every replica editing the same container must use a different client
+func NewContainerWithClient(client Client) *Container {
+	return &Container{
+		mu:      &sync.RWMutex{},
+		emit:    &dispatcher{},
+		client:  client,
+		version: make(Version),
+		roots:   make(map[string]*containerRoot),
+	}
+}
+
+// Text returns the root of the given name, created if the container has none
+//
+// The root is a Doc whose edits, events and undo manager are its own, but whose updates are the ones of the container
+func (c *Container) Text(name string) *Doc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.root(name).doc
+}
+
+// Map returns the map of the root of the given name, created if the container has none
+func (c *Container) Map(name string) *Map {
+	return c.Text(name).Map()
+}
+
+// ContainerSequence returns the root of the given name as a sequence of values of type T,
+// created if the container has none
+//
+// Values received before are decoded as T, the ones that cannot be are reported by Get and Values.
+// Updates adding values to the root that cannot be decoded as T are rejected with ErrInvalidEncoding.
+// Reading the root as a sequence of another type decodes its values again,
+// and the sequences returned before no longer see the values received afterwards
+func ContainerSequence[T any](c *Container, name string) *Sequence[T] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	root := c.root(name)
+	root.sequence = true
+	values, ok := root.doc.elements.(*valueStore[T])
+	if !ok {
+		values = newValueStore[T]()
+		values.load(root.doc, root.doc.elements)
+		root.doc.elements = values
+	}
+	return &Sequence[T]{doc: root.doc, values: values}
+}
+
+// Names returns the names of the roots of the container, in increasing order
+func (c *Container) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Sorted(maps.Keys(c.roots))
+}
+
+// Client returns the client owning the local edits of the container
+//
+// The client changes when a remote update contains edits made with it, see ApplyUpdate
+func (c *Container) Client() Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client
+}
+
+// Version returns a copy of the version of the container, covering all of its roots
+func (c *Container) Version() Version {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return maps.Clone(c.version)
+}
+
+// root returns the root of the given name, creating it if needed
+//
+// The observers of the container are registered on the new root
+func (c *Container) root(name string) *containerRoot {
+	if root, ok := c.roots[name]; ok {
+		return root
+	}
+	root := &containerRoot{doc: c.newRoot()}
+	c.roots[name] = root
+	for _, obs := range c.observers {
+		c.observeRoot(obs, name, root.doc)
+	}
+	return root
+}
+
+// newRoot creates a document sharing the state of the container, without adding it to the container
+//
+// The root keeps the values of its elements in their JSON encoding until it is read as a sequence
+func (c *Container) newRoot() *Doc {
+	doc := NewDocWithClient(c.client)
+	doc.elements = newValueStore[json.RawMessage]()
+	doc.mu = c.mu
+	doc.emit = c.emit
+	doc.version = c.version
+	doc.container = c
+	return doc
+}
+
+// EncodeStateVector encodes the version of the container so that a peer can
+// compute the changes this container is missing with EncodeDiff
+func (c *Container) EncodeStateVector() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return encodeVersion(c.version)
+}
+
+// EncodeDiff encodes the changes of every root that are not in the given state vector
+//
+// An empty state vector encodes the whole container.
+// returns an error if the state vector is malformed or if a value of a sequence cannot be encoded
+func (c *Container) EncodeDiff(state_vector []byte) ([]byte, error) {
+	version, err := decodeVersion(state_vector)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding state vector: %w", err)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sections, err := c.diff(version)
+	if err != nil {
+		return nil, err
+	}
+	return encodeSections(sections), nil
+}
+
+// EncodeState encodes the whole container as an update, which can be persisted
+// and loaded back by applying it to an empty container
+//
+// returns an error if a value of a sequence cannot be encoded
+func (c *Container) EncodeState() ([]byte, error) {
+	return c.EncodeDiff(nil)
+}
+
+// diff returns the changes of every root that are not in the given version, by name
+//
+// returns an error if a value of a sequence cannot be encoded
+func (c *Container) diff(version Version) (map[string]*update, error) {
+	sections := make(map[string]*update, len(c.roots))
+	for name, root := range c.roots {
+		sections[name] = root.doc.diff(version)
+		if err := root.doc.encodeValues(sections[name]); err != nil {
+			return nil, fmt.Errorf("error encoding root %q: %w", name, err)
+		}
+	}
+	return sections, nil
+}
+
+// ApplyUpdate applies an update produced by EncodeDiff on another container
+//
+// Roots of the update that are not in the container are created. As for a Doc, applying
+// the same update several times has no further effect, the update is applied all-or-nothing,
+// and the container continues with a new random client if the update contains edits made with its client.
+// returns ErrInvalidEncoding or ErrMalformedItem if the update is malformed,
+// or ErrClientConflict if it has different edits under ids already in the container
+func (c *Container) ApplyUpdate(data []byte) error {
+	sections, err := decodeSections(data)
+	if err != nil {
+		return fmt.Errorf("error decoding update: %w", err)
+	}
+	return c.transact(func() error {
+		return c.applySections(sections)
+	})
+}
+
+// Merge merges the changes of every root of the other container into this container
+//
+// returns an error if the changes cannot be applied
+func (c *Container) Merge(from *Container) error {
+	if from == c {
+		return nil
+	}
+	version := c.Version()
+	from.mu.RLock()
+	sections, err := from.diff(version)
+	from.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return c.transact(func() error {
+		return c.applySections(sections)
+	})
+}
+
+// ObserveUpdates registers a function called after every change of a root of the container
+// with the update to send to the other replicas, as applied by ApplyUpdate
+//
+// The function is also called for the changes of the roots created later.
+// local tells whether the change has been made locally, remote changes usually don't need to be sent back.
+// returns a function that unregisters the observer
+func (c *Container) ObserveUpdates(fn func(update []byte, local bool)) (unobserve func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obs := &containerObserver{fn: fn, roots: make(map[string]*observer)}
+	c.observers = append(c.observers, obs)
+	for name, root := range c.roots {
+		c.observeRoot(obs, name, root.doc)
+	}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.observers = slices.DeleteFunc(c.observers, func(other *containerObserver) bool { return other == obs })
+		for name, root_obs := range obs.roots {
+			doc := c.roots[name].doc
+			doc.observers = slices.DeleteFunc(doc.observers, func(other *observer) bool { return other == root_obs })
+		}
+	}
+}
+
+// observeRoot registers the observer of the container on the root of the given name,
+// wrapping the updates of the root in updates of the container
+func (c *Container) observeRoot(obs *containerObserver, name string, doc *Doc) {
+	root_obs := &observer{update_fn: func(update []byte, local bool) {
+		obs.fn(wrapSection(name, update), local)
+	}}
+	obs.roots[name] = root_obs
+	doc.observers = append(doc.observers, root_obs)
+}
+
+// transact runs the function with a transaction on every root, then notifies the observers of the changed roots
+//
+// The function may add roots to the container, a transaction is started on them as they are added.
+// returns the error of the function
+func (c *Container) transact(fn func() error) error {
+	c.mu.Lock()
+	for _, root := range c.roots {
+		root.doc.begin(false)
+	}
+	err := fn()
+	var dispatches []func()
+	for _, name := range slices.Sorted(maps.Keys(c.roots)) {
+		if dispatch := c.roots[name].doc.finish(); dispatch != nil {
+			dispatches = append(dispatches, dispatch)
+		}
+	}
+	if len(dispatches) == 0 {
+		c.mu.Unlock()
+		return err
+	}
+	c.emit.push(dispatches...)
+	c.mu.Unlock()
+	c.emit.run()
+	return err
+}
+
+// applySections applies the update of every root, within the transactions of the roots
+//
+// Every section is planned before any root is modified, and the roots the sections create are only
+// added to the container once the update is known to apply. The pending changes of all the roots are
+// then retried until none can progress, since the seqs they wait for may be in any root.
+// returns an error if a section is malformed, or uses ids of another root
+func (c *Container) applySections(sections map[string]*update) error {
+	docs := make(map[string]*Doc, len(sections))
+	plans := make(map[string]*plannedUpdate, len(sections))
+	for _, name := range slices.Sorted(maps.Keys(sections)) {
+		upd := sections[name]
+		doc := c.newRoot()
+		if root, ok := c.roots[name]; ok {
+			doc = root.doc
+			if root.sequence {
+				if err := checkElements(upd); err != nil {
+					return fmt.Errorf("error applying root %q: %w", name, err)
+				}
+			}
+		}
+		plan, err := doc.plan(upd)
+		if err != nil {
+			return fmt.Errorf("error applying root %q: %w", name, err)
+		}
+		docs[name] = doc
+		plans[name] = plan
+	}
+	if err := c.checkRoots(sections); err != nil {
+		return err
+	}
+	for name, doc := range docs {
+		if _, ok := c.roots[name]; !ok {
+			doc.begin(false)
+			c.roots[name] = &containerRoot{doc: doc}
+			for _, obs := range c.observers {
+				c.observeRoot(obs, name, doc)
+			}
+		}
+	}
+	own_seq, had_own := c.version[c.client]
+	for _, name := range slices.Sorted(maps.Keys(plans)) {
+		if err := docs[name].integratePlan(plans[name]); err != nil {
+			return fmt.Errorf("error applying root %q: %w", name, err)
+		}
+	}
+	for progressed := true; progressed; {
+		progressed = false
+		for _, name := range slices.Sorted(maps.Keys(c.roots)) {
+			root_progressed, err := c.roots[name].doc.integratePending()
+			if err != nil {
+				return fmt.Errorf("error applying root %q: %w", name, err)
+			}
+			progressed = progressed || root_progressed
+		}
+	}
+	if seq, ok := c.version[c.client]; ok && (!had_own || seq != own_seq) {
+		// Another replica made edits with our client, later local edits could reuse their seqs
+		c.client = RandomClient()
+		for _, root := range c.roots {
+			root.doc.client = c.client
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(sections)) {
+		if err := docs[name].applyDeletes(sections[name].deleted); err != nil {
+			return fmt.Errorf("error applying root %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// checkRoots checks that the ids claimed by the sections and by the pending changes of a root,
+// as items, entries, marks, deletions or origins, are not claimed by another root
+//
+// Ids in the version are checked by each root, which owns them if they are in its items, entries, marks or deletions.
+// returns ErrClientConflict if two roots claim the same id
+func (c *Container) checkRoots(sections map[string]*update) error {
+	names := slices.Sorted(maps.Keys(c.roots))
+	for name := range sections {
+		if _, ok := c.roots[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	claimed := make(deleteSet)
+	for _, name := range names {
+		ids := make(deleteSet)
+		var items []Item
+		var entries []entry
+		var marks []mark
+		var deletions []deletion
+		if root, ok := c.roots[name]; ok {
+			items = append(items, root.doc.pending...)
+			entries = append(entries, root.doc.pending_entries...)
+			marks = append(marks, root.doc.pending_marks...)
+			deletions = append(deletions, root.doc.pending_deletions...)
+		}
+		if upd, ok := sections[name]; ok {
+			items = append(items, upd.items...)
+			entries = append(entries, upd.entries...)
+			marks = append(marks, upd.marks...)
+			deletions = append(deletions, upd.deletions...)
+		}
+		for _, item := range items {
+			c.claim(ids, item.id, item.length)
+			for _, origin := range []*Id{item.origin_left, item.origin_right} {
+				if origin != nil {
+					c.claim(ids, *origin, 1)
+				}
+			}
+		}
+		for _, e := range entries {
+			c.claim(ids, e.id, 1)
+		}
+		for _, m := range marks {
+			c.claim(ids, m.id, 1)
+		}
+		for _, d := range deletions {
+			c.claim(ids, d.id, 1)
+		}
+		for client, ranges := range ids {
+			for _, r := range ranges {
+				if overlap := claimed.intersect(client, r.start, r.length); len(overlap) > 0 {
+					return fmt.Errorf("%w: root %q uses seq %d of client %d of another root", ErrClientConflict, name, overlap[0].start, client)
+				}
+			}
+		}
+		claimed.merge(ids)
+	}
+	return nil
+}
+
+// claim adds to the set the ids of the range that are not in the version of the container
+func (c *Container) claim(ids deleteSet, id Id, length int) {
+	start := id.seq
+	if seq, ok := c.version[id.client]; ok {
+		start = max(start, seq+1)
+	}
+	if end := id.seq + Seq(length); start < end {
+		ids.add(id.client, start, int(end-start))
+	}
+}
+
+// encodeSections encodes the update of every root, with names in increasing order
+func encodeSections(sections map[string]*update) []byte {
+	enc := encoder{}
+	enc.writeByte(formatVersion)
+	enc.writeUvarint(uint64(len(sections)))
+	for _, name := range slices.Sorted(maps.Keys(sections)) {
+		enc.writeString(name)
+		enc.writeString(string(encodeUpdate(sections[name])))
+	}
+	return enc.buf
+}
+
+// wrapSection encodes an encoded update of a root as an update of the container
+func wrapSection(name string, update []byte) []byte {
+	enc := encoder{}
+	enc.writeByte(formatVersion)
+	enc.writeUvarint(1)
+	enc.writeString(name)
+	enc.writeString(string(update))
+	return enc.buf
+}
+
+// decodeSections decodes the update of every root of a container update
+//
+// returns an error if the update is malformed, or if its names are not valid UTF-8 in increasing order
+func decodeSections(data []byte) (map[string]*update, error) {
+	dec := decoder{buf: data}
+	dec.readFormatVersion()
+	count := dec.readLength()
+	sections := make(map[string]*update, count)
+	var last *string
+	for range count {
+		name := dec.readString()
+		section := dec.readString()
+		if dec.err != nil {
+			break
+		}
+		if !utf8.ValidString(name) || last != nil && name <= *last {
+			dec.fail("names of the roots are not valid UTF-8 in increasing order")
+			break
+		}
+		last = &name
+		upd, err := decodeUpdate([]byte(section))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding root %q: %w", name, err)
+		}
+		sections[name] = upd
+	}
+	if err := dec.finish(); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
@@ -0,0 +1,234 @@
+package fugue
+
+import (
+	"errors"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// syncContainers applies to the second container the changes of the first one it is missing
+func syncContainers(t *testing.T, from *Container, to *Container) {
+	t.Helper()
+	update, err := from.EncodeDiff(to.EncodeStateVector())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := to.ApplyUpdate(update); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// checkContainers checks that the containers have the same roots with the same texts and maps
+func checkContainers(t *testing.T, containers ...*Container) {
+	t.Helper()
+	for _, c := range containers[1:] {
+		if !slices.Equal(c.Names(), containers[0].Names()) {
+			t.Fatalf("Containers diverged: %v and %v", containers[0].Names(), c.Names())
+		}
+		for _, name := range c.Names() {
+			if c.Text(name).Text() != containers[0].Text(name).Text() || !maps.Equal(c.Map(name).All(), containers[0].Map(name).All()) {
+				t.Fatalf("Root %q diverged: '%s' and '%s'", name, containers[0].Text(name).Text(), c.Text(name).Text())
+			}
+		}
+	}
+}
+
+func TestContainer(t *testing.T) {
+	c1 := NewContainerWithClient(1)
+	c2 := NewContainerWithClient(2)
+	c1.Text("title").Insert(0, "Notes")
+	c1.Text("body").Insert(0, "Hello world")
+	c1.Map("meta").Set("owner", "ada")
+	todos := ContainerSequence[todo](c1, "todos")
+	todos.Insert(0, todo{Title: "milk"}, todo{Title: "eggs"})
+	// The roots share the clock of the container
+	if version := c1.Version(); version[1] != 18 || !maps.Equal(c1.Text("body").Version(), version) {
+		t.Errorf("Unexpected version %v", version)
+	}
+	syncContainers(t, c1, c2)
+	checkContainers(t, c1, c2)
+	if !slices.Equal(c2.Names(), []string{"body", "meta", "title", "todos"}) {
+		t.Errorf("Unexpected roots %v", c2.Names())
+	}
+	if values := sequenceValues(t, ContainerSequence[todo](c2, "todos")); !slices.Equal(values, sequenceValues(t, todos)) {
+		t.Errorf("Unexpected values %v", values)
+	}
+	// Concurrent edits of several roots
+	c1.Text("title").Insert(5, "!")
+	c2.Text("body").Delete(0, 6)
+	c2.Text("title").Insert(0, "My ")
+	ContainerSequence[todo](c2, "todos").Delete(0, 1)
+	syncContainers(t, c1, c2)
+	syncContainers(t, c2, c1)
+	checkContainers(t, c1, c2)
+	if c1.Text("title").Text() != "My Notes!" || c1.Text("body").Text() != "world" || todos.Len() != 1 {
+		t.Errorf("Unexpected content '%s' '%s' %v", c1.Text("title").Text(), c1.Text("body").Text(), sequenceValues(t, todos))
+	}
+	// The whole state is loaded back in an empty container
+	state, err := c1.EncodeState()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	loaded := NewContainerWithClient(3)
+	if err := loaded.ApplyUpdate(state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkContainers(t, c1, loaded)
+	// Roots are synced with their container
+	if err := c1.Text("body").ApplyUpdate(NewDocWithClient(4).EncodeState()); !errors.Is(err, ErrContainerRoot) {
+		t.Errorf("Unexpected error for a root applying an update: %v", err)
+	}
+	if err := c1.Text("body").Merge(NewDocWithClient(4)); !errors.Is(err, ErrContainerRoot) {
+		t.Errorf("Unexpected error for a root merging a document: %v", err)
+	}
+	// A root cannot be encoded or merged on its own, as its seqs are shared with the other roots
+	standalone := NewDocWithClient(4)
+	if err := standalone.Merge(c1.Text("body")); !errors.Is(err, ErrContainerRoot) || standalone.Text() != "" {
+		t.Errorf("Unexpected error for a document merging a root: %v", err)
+	}
+	if _, err := c1.Text("body").EncodeDiff(nil); !errors.Is(err, ErrContainerRoot) {
+		t.Errorf("Unexpected error for a root encoding a diff: %v", err)
+	}
+	if state := c1.Text("body").EncodeState(); state != nil {
+		t.Errorf("Unexpected state of a root: %v", state)
+	}
+	// Values of another type are rejected by a sequence root
+	c3 := NewContainerWithClient(5)
+	ContainerSequence[int](c3, "todos")
+	if err := c3.ApplyUpdate(state); !errors.Is(err, ErrInvalidEncoding) || len(c3.Version()) != 0 {
+		t.Errorf("Unexpected error for values of another type: %v", err)
+	}
+}
+
+func TestContainerSequenceValues(t *testing.T) {
+	c1 := NewContainerWithClient(1)
+	c2 := NewContainerWithClient(2)
+	ContainerSequence[any](c1, "list").Insert(0, 1, "two", 3)
+	syncContainers(t, c1, c2)
+	// Values received before the root is read as a sequence are decoded then
+	if values := sequenceValues(t, ContainerSequence[any](c2, "list")); !slices.Equal(values, []any{1.0, "two", 3.0}) {
+		t.Errorf("Unexpected values %v", values)
+	}
+	// Values that are not a T are reported
+	ints := ContainerSequence[int](c2, "list")
+	if value, err := ints.Get(0); err != nil || value != 1 {
+		t.Errorf("Unexpected value %v: %v", value, err)
+	}
+	if _, err := ints.Get(1); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Unexpected error for a value of another type: %v", err)
+	}
+	if _, err := ints.Values(); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Unexpected error for the values: %v", err)
+	}
+	// They are still sent to the other replicas
+	c3 := NewContainerWithClient(3)
+	syncContainers(t, c2, c3)
+	if values := sequenceValues(t, ContainerSequence[any](c3, "list")); !slices.Equal(values, []any{1.0, "two", 3.0}) {
+		t.Errorf("Unexpected values %v", values)
+	}
+	// The GC drops the values of the collected elements
+	ints.Delete(0, 2)
+	if err := c2.Text("list").GC(c2.Version()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if runs := ints.values.runs[1]; len(runs) != 1 || runs[0].start != 2 || len(ints.values.invalid) != 0 {
+		t.Errorf("Unexpected values after the GC %v %v", runs, ints.values.invalid)
+	}
+	if values := sequenceValues(t, ints); !slices.Equal(values, []int{3}) {
+		t.Errorf("Unexpected values %v", values)
+	}
+}
+
+func TestContainerUpdates(t *testing.T) {
+	c1 := NewContainerWithClient(1)
+	c2 := NewContainerWithClient(2)
+	var updates [][]byte
+	unobserve := c1.ObserveUpdates(func(update []byte, local bool) {
+		updates = append(updates, update)
+	})
+	// The observer is notified of the roots created after it
+	c1.Text("body").Insert(0, "a")
+	c1.Text("title").Insert(0, "b")
+	c1.Text("body").Insert(1, "c")
+	unobserve()
+	c1.Text("body").Insert(2, "d")
+	if len(updates) != 3 {
+		t.Fatalf("Unexpected updates %d", len(updates))
+	}
+	// The last update of the body waits for the seq of the title
+	for _, i := range []int{2, 0} {
+		if err := c2.ApplyUpdate(updates[i]); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if c2.Text("body").Text() != "a" {
+		t.Errorf("Unexpected body '%s'", c2.Text("body").Text())
+	}
+	if err := c2.ApplyUpdate(updates[1]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c2.Text("body").Text() != "ac" || c2.Text("title").Text() != "b" {
+		t.Errorf("Unexpected content '%s' '%s'", c2.Text("body").Text(), c2.Text("title").Text())
+	}
+	// A seq used by two roots is a conflict, and the update is not applied
+	forked := NewContainerWithClient(1)
+	forked.Text("other").Insert(0, "xyz")
+	version := c2.Version()
+	state, _ := forked.EncodeState()
+	if err := c2.ApplyUpdate(state); !errors.Is(err, ErrClientConflict) {
+		t.Errorf("Unexpected error for a seq of another root: %v", err)
+	}
+	if !maps.Equal(c2.Version(), version) || slices.Contains(c2.Names(), "other") {
+		t.Errorf("Unexpected changes %v %v", c2.Version(), c2.Names())
+	}
+	// Updates of a Doc are not container updates
+	if err := c2.ApplyUpdate(NewDocWithClient(3).EncodeState()); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Unexpected error for a document update: %v", err)
+	}
+}
+
+func TestContainerFuzzer(t *testing.T) {
+	const trials int64 = 30
+	names := []string{"title", "body", "notes"}
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		containers := []*Container{NewContainerWithClient(0), NewContainerWithClient(1), NewContainerWithClient(2)}
+		var updates [][]byte
+		containers[0].ObserveUpdates(func(update []byte, local bool) {
+			updates = append(updates, update)
+		})
+		for range 200 {
+			j := rng.Intn(len(containers))
+			name := names[rng.Intn(len(names))]
+			if rng.Float32() < 0.2 {
+				containers[j].Map(name).Set("key", string(rune('a'+rng.Intn(26))))
+			} else {
+				randomEdit(t, rng, containers[j].Text(name))
+			}
+			if rng.Float32() < 0.3 {
+				k := rng.Intn(len(containers))
+				syncContainers(t, containers[j], containers[k])
+				syncContainers(t, containers[k], containers[j])
+				checkContainers(t, containers[j], containers[k])
+			}
+		}
+		for _, c := range containers[1:] {
+			syncContainers(t, containers[0], c)
+			syncContainers(t, c, containers[0])
+		}
+		for _, c := range containers[1:] {
+			syncContainers(t, containers[0], c)
+		}
+		checkContainers(t, containers...)
+		// The updates of a container can be applied in any order
+		late := NewContainerWithClient(3)
+		for _, k := range rng.Perm(len(updates)) {
+			if err := late.ApplyUpdate(updates[k]); err != nil {
+				t.Fatalf("Trial %d: unexpected error: %v", i, err)
+			}
+		}
+		checkContainers(t, containers[0], late)
+	}
+}
@@ -0,0 +1,329 @@
+package fugue
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+)
+
+// seqRange is a range of consecutive seqs of a client
+type seqRange struct {
+	start  Seq
+	length int
+}
+
+// end returns the first seq after the range
+func (r seqRange) end() Seq {
+	return r.start + Seq(r.length)
+}
+
+// deleteSet is the set of deleted ids, stored as sorted and disjoint ranges for every client
+//
+// Adding ranges is idempotent, so delete sets can be merged in any order
+type deleteSet map[Client][]seqRange
+
+// add adds the range of ids to the set, merging it with the overlapping and adjacent ranges
+func (ds deleteSet) add(client Client, start Seq, length int) {
+	if length <= 0 {
+		return
+	}
+	ranges := ds[client]
+	end := start + Seq(length)
+	// Find the first range that ends at or after the start of the new range
+	first := sort.Search(len(ranges), func(i int) bool { return ranges[i].end() >= start })
+	last := first
+	for last < len(ranges) && ranges[last].start <= end {
+		start = min(start, ranges[last].start)
+		end = max(end, ranges[last].end())
+		last++
+	}
+	ds[client] = slices.Replace(ranges, first, last, seqRange{start: start, length: int(end - start)})
+}
+
+// merge adds all the ranges of the other delete set to this one
+func (ds deleteSet) merge(other deleteSet) {
+	for client, ranges := range other {
+		for _, r := range ranges {
+			ds.add(client, r.start, r.length)
+		}
+	}
+}
+
+// contains checks if the id is in the delete set
+//
+// returns true if the id has been deleted
+func (ds deleteSet) contains(id Id) bool {
+	ranges := ds[id.client]
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].end() > id.seq })
+	return i < len(ranges) && ranges[i].start <= id.seq
+}
+
+// intersect returns the parts of the delete set inside the given range of ids
+func (ds deleteSet) intersect(client Client, start Seq, length int) []seqRange {
+	ranges := ds[client]
+	end := start + Seq(length)
+	var result []seqRange
+	for i := sort.Search(len(ranges), func(i int) bool { return ranges[i].end() > start }); i < len(ranges) && ranges[i].start < end; i++ {
+		from := max(start, ranges[i].start)
+		to := min(end, ranges[i].end())
+		result = append(result, seqRange{start: from, length: int(to - from)})
+	}
+	return result
+}
+
+// complement returns the parts of the given range of ids that are not in the delete set
+func (ds deleteSet) complement(client Client, start Seq, length int) []seqRange {
+	var result []seqRange
+	for _, r := range ds.intersect(client, start, length) {
+		if r.start > start {
+			result = append(result, seqRange{start: start, length: int(r.start - start)})
+		}
+		length -= int(r.end() - start)
+		start = r.end()
+	}
+	if length > 0 {
+		result = append(result, seqRange{start: start, length: length})
+	}
+	return result
+}
+
+// clone returns a deep copy of the delete set
+func (ds deleteSet) clone() deleteSet {
+	copied := make(deleteSet, len(ds))
+	for client, ranges := range ds {
+		copied[client] = slices.Clone(ranges)
+	}
+	return copied
+}
+
+// remove removes the range of ids from the set, splitting the ranges it overlaps
+func (ds deleteSet) remove(client Client, start Seq, length int) {
+	end := start + Seq(length)
+	var kept []seqRange
+	for _, r := range ds[client] {
+		if r.end() <= start || r.start >= end {
+			kept = append(kept, r)
+			continue
+		}
+		if r.start < start {
+			kept = append(kept, seqRange{start: r.start, length: int(start - r.start)})
+		}
+		if r.end() > end {
+			kept = append(kept, seqRange{start: end, length: int(r.end() - end)})
+		}
+	}
+	if len(kept) == 0 {
+		delete(ds, client)
+		return
+	}
+	ds[client] = kept
+}
+
+// Every local transaction deleting characters records their ids in a deletion, which takes the next seq
+// of its client like the marks and the entries of the map. The state vector covers the deletions,
+// so a diff only holds the deletions the peer is missing, while the delete set is always sent whole.
+// Deletions only tell which client deleted the characters, for Changes, the delete set marks them as deleted.
+// Once a deletion is in every replica, the GC drops the ids whose content it collected from it.
+
+// deletion records the ids deleted by a local transaction of its client
+type deletion struct {
+	id      Id        // client and seq of the deletion, taken from the clock of the items
+	deleted deleteSet // ids deleted by the transaction, without the ones collected by the GC
+}
+
+// deleters maps every client to the ids it deleted, indexing the deletions of a document, see changes.go
+//
+// A character deleted concurrently by several clients is in the delete set of each of them
+type deleters map[Client]deleteSet
+
+// merge adds all the ids of the delete set to the ids deleted by the client 'by'
+func (d deleters) merge(by Client, ds deleteSet) {
+	if d[by] == nil {
+		d[by] = make(deleteSet)
+	}
+	d[by].merge(ds)
+}
+
+// markDeleted marks the item as deleted and records its ids in the delete set of the document
+// and in the delete set of the running transaction
+func (doc *Doc) markDeleted(linked_item *linkedItem) {
+	id := linked_item.item.id
+	doc.content.markDeleted(linked_item)
+	doc.deleted.add(id.client, id.seq, linked_item.item.length)
+	if doc.tx != nil {
+		doc.tx.deleted.add(id.client, id.seq, linked_item.item.length)
+	}
+}
+
+// recordDeletion records the ids deleted by the local transaction as a deletion of the client of the document
+func (doc *Doc) recordDeletion() {
+	if !doc.tx.local || len(doc.tx.deleted) == 0 {
+		return
+	}
+	doc.integrateDeletion(deletion{id: Id{client: doc.client, seq: doc.nextSeq(doc.client)}, deleted: doc.tx.deleted.clone()})
+}
+
+// integrateDeletion adds the deletion to the document and to the running transaction
+//
+// The deletion must be the next seq of its client
+func (doc *Doc) integrateDeletion(d deletion) {
+	doc.version[d.id.client] = d.id.seq
+	doc.deletions[d.id] = d
+	doc.deleted_by.merge(d.id.client, d.deleted)
+	if doc.tx != nil {
+		doc.tx.deletions = append(doc.tx.deletions, d)
+	}
+}
+
+// planDeletions merges the deletions of an update with the pending deletions
+//
+// The GC drops ids from the deletions every replica has, so deletions with the same id are not compared.
+// returns the deletions that are not in the document, sorted by client and seq,
+// or an error if a seq of a deletion is another change of the document
+func (doc *Doc) planDeletions(deletions []deletion) ([]deletion, error) {
+	planned := slices.Clone(doc.pending_deletions)
+	for _, d := range deletions {
+		if !isInVersion(&d.id, &doc.version) {
+			planned = append(planned, d)
+			continue
+		}
+		if _, ok := doc.deletions[d.id]; !ok {
+			return nil, fmt.Errorf("%w: client %d differs at seq %d", ErrClientConflict, d.id.client, d.id.seq)
+		}
+	}
+	slices.SortFunc(planned, compareDeletionIds)
+	planned = slices.CompactFunc(planned, func(a, b deletion) bool { return a.id == b.id })
+	return planned, nil
+}
+
+// integrateDeletions integrates the pending deletions that follow the last seq of their client
+//
+// returns true if some deletions were integrated, which may allow pending items to be integrated
+func (doc *Doc) integrateDeletions() bool {
+	progressed := false
+	pending := doc.pending_deletions[:0]
+	for _, d := range doc.pending_deletions {
+		switch {
+		case isInVersion(&d.id, &doc.version):
+			// The change was integrated before the items following it, or the seq was taken
+			// by another change as the client has forked
+		case d.id.seq == doc.nextSeq(d.id.client):
+			doc.integrateDeletion(d)
+			progressed = true
+		default:
+			pending = append(pending, d)
+		}
+	}
+	doc.pending_deletions = pending
+	return progressed
+}
+
+// sortedDeletions returns the deletions of the document, sorted by client and seq
+func (doc *Doc) sortedDeletions() []deletion {
+	deletions := slices.Collect(maps.Values(doc.deletions))
+	slices.SortFunc(deletions, compareDeletionIds)
+	return deletions
+}
+
+// compareDeletionIds orders the deletions by client, then by seq
+func compareDeletionIds(a deletion, b deletion) int {
+	return cmp.Or(cmp.Compare(a.id.client, b.id.client), cmp.Compare(a.id.seq, b.id.seq))
+}
+
+// pruneDeletions drops the collected ids from the deletions that every replica has
+//
+// A replica missing a deletion may still have the content of its ids, so the other deletions are kept whole
+func (doc *Doc) pruneDeletions(stable Version, collected deleteSet) {
+	for id, d := range doc.deletions {
+		if !isInVersion(&id, &stable) {
+			continue
+		}
+		for client, ranges := range d.deleted.clone() {
+			for _, r := range ranges {
+				for _, pruned := range collected.intersect(client, r.start, r.length) {
+					d.deleted.remove(client, pruned.start, pruned.length)
+					doc.deleted_by[id.client].remove(client, pruned.start, pruned.length)
+				}
+			}
+		}
+	}
+}
+
+// applyDeletes records the deleted ids and marks the matching items of the document as deleted
+//
+// Deleted ids that are not yet in the document are kept in the delete set,
+// and applied when the matching items are integrated
+// returns an error if an item cannot be split
+func (doc *Doc) applyDeletes(ds deleteSet) error {
+	doc.deleted.merge(ds)
+	for client, ranges := range ds {
+		for _, r := range ranges {
+			if err := doc.deleteRange(client, r.start, r.length); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteRange marks as deleted the items of the document in the given range of ids
+//
+// The part of the range that is not in the version of the document is ignored
+// returns an error if an item cannot be split
+func (doc *Doc) deleteRange(client Client, start Seq, length int) error {
+	known, ok := doc.version[client]
+	if !ok {
+		return nil
+	}
+	end := min(start+Seq(length), known+1)
+	for seq := start; seq < end; {
+		linked_item := doc.content.findId(Id{client: client, seq: seq})
+		if linked_item == nil {
+			// Entries of the map are not deleted, they are overwritten, and the items
+			// of the other roots of a container are not in the document, skip to the next item
+			seq = doc.content.nextSeq(Id{client: client, seq: seq}, end)
+			continue
+		}
+		item_end := linked_item.item.id.seq + Seq(linked_item.item.length)
+		if linked_item.item.deleted {
+			// Nothing to do, skip to the end of the item
+			seq = item_end
+			continue
+		}
+		// Split the item into three parts: before, the deleted part, and after
+		_, middle, err := doc.content.splitTwo(linked_item, int(seq-linked_item.item.id.seq))
+		if err != nil {
+			return fmt.Errorf("error splitting item: %w", err)
+		}
+		middle, _, err = doc.content.splitTwo(middle, int(min(end, item_end)-seq))
+		if err != nil {
+			return fmt.Errorf("error splitting item: %w", err)
+		}
+		seq = min(end, item_end)
+		doc.markDeleted(middle)
+		if middle.canMergeLeft() {
+			// We can merge the deleted part with the previous item
+			doc.content.mergeLeft(middle)
+			// Move to the previous item, so that we can do merging in both directions
+			middle = middle.prev
+		}
+		if middle.canMergeRight() {
+			// We can merge the deleted part with the next item
+			doc.content.mergeRight(middle)
+		}
+	}
+	return nil
+}
+
+// deleteIntegrated marks as deleted the parts of a newly integrated item that are in the delete set,
+// which happens when the deletion has been received before the item
+func (doc *Doc) deleteIntegrated(item Item) error {
+	for _, r := range doc.deleted.intersect(item.id.client, item.id.seq, item.length) {
+		if err := doc.deleteRange(item.id.client, r.start, r.length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package fugue
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDeleteSetAdd(t *testing.T) {
+	ds := make(deleteSet)
+	ds.add(1, 10, 2)
+	ds.add(1, 0, 3)
+	ds.add(1, 5, 1)
+	// Adjacent and overlapping ranges are merged
+	ds.add(1, 3, 2)
+	ds.add(1, 9, 4)
+	ds.add(1, 9, 4)
+	ds.add(2, 7, 1)
+	expected := []seqRange{{start: 0, length: 6}, {start: 9, length: 4}}
+	if !slices.Equal(ds[1], expected) {
+		t.Errorf("Unexpected ranges: %v, expected %v", ds[1], expected)
+	}
+	for seq, deleted := range []bool{true, true, true, true, true, true, false, false, false, true, true, true, true, false} {
+		if ds.contains(Id{client: 1, seq: Seq(seq)}) != deleted {
+			t.Errorf("Unexpected contains for seq %d, expected %t", seq, deleted)
+		}
+	}
+	if ds.contains(Id{client: 2, seq: 6}) || !ds.contains(Id{client: 2, seq: 7}) || ds.contains(Id{client: 3, seq: 7}) {
+		t.Errorf("Unexpected contains for other clients: %v", ds)
+	}
+	intersection := ds.intersect(1, 4, 7)
+	expected = []seqRange{{start: 4, length: 2}, {start: 9, length: 2}}
+	if !slices.Equal(intersection, expected) {
+		t.Errorf("Unexpected intersection: %v, expected %v", intersection, expected)
+	}
+}
+
+func TestDeleteSetMergeIdempotent(t *testing.T) {
+	ds1 := make(deleteSet)
+	ds1.add(1, 0, 2)
+	ds1.add(2, 4, 2)
+	ds2 := make(deleteSet)
+	ds2.add(1, 2, 2)
+	merged := ds1.clone()
+	merged.merge(ds2)
+	merged.merge(ds2)
+	merged.merge(ds1)
+	if !slices.Equal(merged[1], []seqRange{{start: 0, length: 4}}) || !slices.Equal(merged[2], ds1[2]) {
+		t.Errorf("Unexpected merged delete set: %v", merged)
+	}
+	if len(ds1[1]) != 1 || ds1[1][0].length != 2 {
+		t.Errorf("Clone shares its ranges with the original: %v", ds1)
+	}
+}
+
+func TestDeleteBeforeInsert(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc3 := NewDocWithClient(3)
+	doc1.Insert(0, "abcdef")
+	syncDocs(t, doc1, doc2)
+	doc2.Delete(1, 4)
+	// doc3 receives the deletion before the deleted items
+	deletion := encodeUpdate(&update{deleted: doc2.deleted})
+	if err := doc3.ApplyUpdate(deletion); err != nil {
+		t.Fatalf("Unexpected error applying deletion: %v", err)
+	}
+	syncDocs(t, doc1, doc3)
+	if doc3.Text() != "af" || doc2.Text() != "af" {
+		t.Errorf("Unexpected content: doc2='%s', doc3='%s'", doc2.Text(), doc3.Text())
+	}
+	if !slices.Equal(doc3.deleted[1], []seqRange{{start: 1, length: 4}}) {
+		t.Errorf("Unexpected delete set: %v", doc3.deleted)
+	}
+}
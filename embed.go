@@ -0,0 +1,61 @@
+package fugue
+
+import (
+	"fmt"
+)
+
+// Embeds are images, mentions or widgets inline with the text. An embed is an item of length 1
+// whose content is embedContent and which carries an opaque payload, such as bytes or a JSON value.
+// It is never merged with other items, so its payload stays attached to its id through splits, deletions and syncs.
+
+// embedContent is the content of an embed in the text, the Unicode object replacement character
+const embedContent Content = "￼"
+
+// InsertEmbed inserts an embed with the given payload at the given position, counted in the unit of the document
+//
+// The embed appears as U+FFFC in the text, and counts as this character in every unit.
+// returns an error if the position is out of bounds or inside a character, or if the payload is empty
+func (doc *Doc) InsertEmbed(position int, payload []byte) error {
+	return doc.Transact(func(tx *Tx) error {
+		return tx.InsertEmbed(position, payload)
+	})
+}
+
+// InsertEmbed inserts an embed with the given payload at the given position, counted in the unit of the document
+//
+// returns an error if the position is out of bounds or inside a character, or if the payload is empty
+func (tx *Tx) InsertEmbed(position int, payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("the payload of an embed must not be empty")
+	}
+	position, err := tx.doc.toRunes(position)
+	if err != nil {
+		return err
+	}
+	return tx.doc.localInsert(tx.doc.client, position, embedContent, append([]byte(nil), payload...))
+}
+
+// EmbedAt returns the payload of the embed at the given position, counted in the unit of the document
+//
+// returns an error if the position is out of bounds or inside a character, or ErrNotFound if the character is not an embed
+func (doc *Doc) EmbedAt(position int) ([]byte, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	runes, err := doc.toRunes(position)
+	if err != nil {
+		return nil, err
+	}
+	linked_item, _, out_of_bound := doc.findItemAt(runes, false)
+	if out_of_bound != nil {
+		return nil, out_of_bound
+	}
+	if linked_item.item.embed == nil {
+		return nil, fmt.Errorf("%w: no embed at %d", ErrNotFound, position)
+	}
+	return append([]byte(nil), linked_item.item.embed...), nil
+}
+
+// validEmbed checks that the item is text, or an embed with a payload and the content of an embed
+func validEmbed(item Item) bool {
+	return item.embed == nil || (len(item.embed) > 0 && item.content == embedContent && item.length == 1)
+}
@@ -0,0 +1,116 @@
+package fugue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// checkEmbeds checks that the embeds of the document are alone in their items
+func checkEmbeds(t *testing.T, doc *Doc) {
+	t.Helper()
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		if item := linked_item.item; item.embed != nil && (item.length != 1 || item.content != embedContent) {
+			t.Fatalf("Embed %d:%d merged in an item of length %d", item.id.client, item.id.seq, item.length)
+		}
+	}
+}
+
+func TestEmbeds(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	var events []Event
+	doc2.Observe(func(event Event) { events = append(events, event) })
+	doc1.Insert(0, "ab")
+	if err := doc1.InsertEmbed(1, []byte(`{"image":"cat.png"}`)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	doc1.InsertEmbed(2, []byte("@alice"))
+	doc1.Insert(3, "c")
+	if doc1.Text() != "a￼￼cb" {
+		t.Fatalf("Unexpected content: '%s'", doc1.Text())
+	}
+	checkEmbeds(t, doc1)
+	syncDocs(t, doc1, doc2)
+	expected_delta := []DeltaOp{{Insert: "a"}, {Embed: []byte(`{"image":"cat.png"}`)}, {Embed: []byte("@alice")}, {Insert: "cb"}}
+	if len(events) != 1 || !equalDeltas(events[0].Delta, expected_delta) {
+		t.Errorf("Unexpected events: %v, expected %v", events, expected_delta)
+	}
+	// Embeds survive syncs and persistence
+	data, err := json.Marshal(doc2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	doc3 := NewDocWithClient(3)
+	if err := json.Unmarshal(data, doc3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, doc := range []*Doc{doc1, doc2, doc3} {
+		if payload, err := doc.EmbedAt(2); err != nil || string(payload) != "@alice" {
+			t.Errorf("Unexpected embed: '%s' %v", payload, err)
+		}
+	}
+	if _, err := doc1.EmbedAt(3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unexpected error for a character that is not an embed: %v", err)
+	}
+	runs := doc2.FormattedRuns()
+	if len(runs) != 4 || runs[0].Text != "a" || !bytes.Equal(runs[2].Embed, []byte("@alice")) || runs[3].Text != "cb" {
+		t.Errorf("Unexpected runs: %v", runs)
+	}
+	// Undoing the deletion of an embed restores its payload
+	um, _ := newTestUndoManager(doc2)
+	doc2.Delete(1, 2)
+	if err := um.Undo(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if payload, err := doc2.EmbedAt(1); err != nil || string(payload) != `{"image":"cat.png"}` {
+		t.Errorf("Unexpected embed after undo: '%s' %v", payload, err)
+	}
+	checkEmbeds(t, doc2)
+	// Embeds are validated
+	if err := doc1.InsertEmbed(0, nil); err == nil {
+		t.Errorf("Unexpected success inserting an embed without payload")
+	}
+	malformed := `{"items": [{"id": {"client": 5, "seq": 0}, "content": "xy", "embed": "eA=="}], "deleted": {}}`
+	if _, err := UpdateFromJSON([]byte(malformed)); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Unexpected error for an embed of two characters: %v", err)
+	}
+}
+
+func TestEmbedsFuzzer(t *testing.T) {
+	const trials int64 = 50
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		for n := range 200 {
+			j := rng.Intn(len(docs))
+			doc := docs[j]
+			if rng.Float32() < 0.2 {
+				doc.InsertEmbed(rng.Intn(doc.Len()+1), []byte(fmt.Sprintf("embed %d", n)))
+			} else {
+				randomEdit(t, rng, doc)
+			}
+			if rng.Float32() < 0.2 {
+				syncDocs(t, doc, docs[rng.Intn(len(docs))])
+			}
+		}
+		for j := range docs {
+			for k := range docs {
+				syncDocs(t, docs[j], docs[k])
+			}
+		}
+		runs := docs[0].FormattedRuns()
+		for k, doc := range docs {
+			checkEmbeds(t, doc)
+			checkTree(t, &doc.content)
+			other := doc.FormattedRuns()
+			if !slices.EqualFunc(other, runs, func(a, b FormattedRun) bool { return a.Text == b.Text && bytes.Equal(a.Embed, b.Embed) }) {
+				t.Fatalf("Trial %d: doc %d has runs %v, expected %v", i, k, other, runs)
+			}
+		}
+	}
+}
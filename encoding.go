@@ -0,0 +1,570 @@
+package fugue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+)
+
+// formatVersion is written at the start of every encoded state vector and update,
+// so that the format can evolve while data of an unknown format is rejected
+const formatVersion byte = 1
+
+// Flags of the info byte describing how an item is encoded
+const (
+	flagOriginLeft            byte = 1 << 0 // the item has an origin_left
+	flagOriginRight           byte = 1 << 1 // the item has an origin_right
+	flagOriginLeftPrevious    byte = 1 << 2 // the origin_left is the previous id of the same client and is not written
+	flagOriginLeftSameClient  byte = 1 << 3 // the origin_left is from the same client and written relative to the item
+	flagOriginRightSameClient byte = 1 << 4 // the origin_right is from the same client and written relative to the item
+	flagSeqGap                byte = 1 << 5 // the item does not start where the previous item of the client ended
+	flagCollected             byte = 1 << 6 // the content of the item was collected, only its length is written
+	flagEmbed                 byte = 1 << 7 // the item is an embed, its payload is written instead of its content
+)
+
+// encoder appends values to a growing buffer
+type encoder struct {
+	buf     []byte
+	clients map[Client]uint64 // index of every client in the client table, nil to write clients in full
+}
+
+func (enc *encoder) writeUvarint(value uint64) {
+	enc.buf = binary.AppendUvarint(enc.buf, value)
+}
+
+func (enc *encoder) writeVarint(value int64) {
+	enc.buf = binary.AppendVarint(enc.buf, value)
+}
+
+func (enc *encoder) writeByte(value byte) {
+	enc.buf = append(enc.buf, value)
+}
+
+func (enc *encoder) writeString(value string) {
+	enc.writeUvarint(uint64(len(value)))
+	enc.buf = append(enc.buf, value...)
+}
+
+func (enc *encoder) writeClient(client Client) {
+	if enc.clients != nil {
+		enc.writeUvarint(enc.clients[client])
+		return
+	}
+	enc.writeUvarint(uint64(client))
+}
+
+// decoder reads values from a buffer, remembering the first error encountered
+//
+// Once an error occurred, every read returns a zero value
+type decoder struct {
+	buf     []byte
+	err     error
+	clients []Client // client table of the data, nil if clients are written in full
+}
+
+func (dec *decoder) fail(format string, args ...any) {
+	if dec.err == nil {
+		dec.err = fmt.Errorf("%w: %s", ErrInvalidEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (dec *decoder) readUvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	value, size := binary.Uvarint(dec.buf)
+	if size <= 0 {
+		dec.fail("bad varint")
+		return 0
+	}
+	dec.buf = dec.buf[size:]
+	return value
+}
+
+func (dec *decoder) readVarint() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	value, size := binary.Varint(dec.buf)
+	if size <= 0 {
+		dec.fail("bad varint")
+		return 0
+	}
+	dec.buf = dec.buf[size:]
+	return value
+}
+
+func (dec *decoder) readByte() byte {
+	if dec.err != nil {
+		return 0
+	}
+	if len(dec.buf) == 0 {
+		dec.fail("unexpected end of data")
+		return 0
+	}
+	value := dec.buf[0]
+	dec.buf = dec.buf[1:]
+	return value
+}
+
+// readLength reads a length that must fit in the remaining data
+func (dec *decoder) readLength() int {
+	length := dec.readUvarint()
+	if length > uint64(len(dec.buf)) {
+		dec.fail("length %d exceeds the remaining %d bytes", length, len(dec.buf))
+		return 0
+	}
+	return int(length)
+}
+
+func (dec *decoder) readString() string {
+	length := dec.readLength()
+	if dec.err != nil {
+		return ""
+	}
+	value := string(dec.buf[:length])
+	dec.buf = dec.buf[length:]
+	return value
+}
+
+func (dec *decoder) readClient() Client {
+	value := dec.readUvarint()
+	if dec.clients == nil {
+		return Client(value)
+	}
+	if value >= uint64(len(dec.clients)) {
+		dec.fail("client index %d out of range", value)
+		return 0
+	}
+	return dec.clients[value]
+}
+
+// checkSeq fails if the seq is out of range
+func (dec *decoder) checkSeq(seq int64) Seq {
+	if seq < 0 || seq > int64(maxSeq) {
+		dec.fail("seq %d out of range", seq)
+		return 0
+	}
+	return Seq(seq)
+}
+
+func (dec *decoder) readSeq() Seq {
+	seq := dec.readUvarint()
+	if seq > uint64(maxSeq) {
+		dec.fail("seq %d out of range", seq)
+		return 0
+	}
+	return Seq(seq)
+}
+
+// readFormatVersion checks that the data has been encoded with a known format
+func (dec *decoder) readFormatVersion() {
+	version := dec.readByte()
+	if dec.err == nil && version != formatVersion {
+		dec.fail("unknown format version %d", version)
+	}
+}
+
+// finish checks that the whole buffer has been consumed
+func (dec *decoder) finish() error {
+	if dec.err == nil && len(dec.buf) > 0 {
+		dec.fail("%d trailing bytes", len(dec.buf))
+	}
+	return dec.err
+}
+
+// sortedClients returns the keys of the map in increasing order
+func sortedClients[V any](values map[Client]V) []Client {
+	clients := make([]Client, 0, len(values))
+	for client := range values {
+		clients = append(clients, client)
+	}
+	slices.Sort(clients)
+	return clients
+}
+
+// writeVersion encodes the version with clients in increasing order
+func (enc *encoder) writeVersion(version Version) {
+	enc.writeUvarint(uint64(len(version)))
+	for _, client := range sortedClients(version) {
+		enc.writeClient(client)
+		enc.writeUvarint(uint64(version[client]))
+	}
+}
+
+func (dec *decoder) readVersion() Version {
+	count := dec.readLength()
+	version := make(Version, count)
+	for range count {
+		client := dec.readClient()
+		seq := dec.readSeq()
+		if dec.err != nil {
+			return nil
+		}
+		version[client] = seq
+	}
+	return version
+}
+
+// writeDeleteSet encodes the ranges of the delete set with clients in increasing order
+//
+// The start of every range is written relative to the end of the previous range of the client
+func (enc *encoder) writeDeleteSet(ds deleteSet) {
+	enc.writeUvarint(uint64(len(ds)))
+	for _, client := range sortedClients(ds) {
+		enc.writeClient(client)
+		enc.writeUvarint(uint64(len(ds[client])))
+		var end Seq = 0
+		for _, r := range ds[client] {
+			enc.writeUvarint(uint64(r.start - end))
+			enc.writeUvarint(uint64(r.length))
+			end = r.end()
+		}
+	}
+}
+
+func (dec *decoder) readDeleteSet() deleteSet {
+	ds := make(deleteSet)
+	count := dec.readLength()
+	for range count {
+		client := dec.readClient()
+		ranges := dec.readLength()
+		var end int64 = 0
+		for range ranges {
+			start := dec.checkSeq(end + int64(dec.readSeq()))
+			length := dec.readSeq()
+			if dec.err != nil {
+				return nil
+			}
+			if length == 0 || int64(start)+int64(length) > int64(maxSeq)+1 {
+				dec.fail("invalid deleted range of length %d at %d", length, start)
+				return nil
+			}
+			ds.add(client, start, int(length))
+			end = int64(start) + int64(length)
+		}
+	}
+	return ds
+}
+
+// writeDeletions encodes the deletions with their seq, and the ids they deleted as a delete set
+func (enc *encoder) writeDeletions(deletions []deletion) {
+	enc.writeUvarint(uint64(len(deletions)))
+	for _, d := range deletions {
+		enc.writeClient(d.id.client)
+		enc.writeUvarint(uint64(d.id.seq))
+		enc.writeDeleteSet(d.deleted)
+	}
+}
+
+func (dec *decoder) readDeletions() []deletion {
+	count := dec.readLength()
+	deletions := make([]deletion, 0, count)
+	for range count {
+		var d deletion
+		d.id.client = dec.readClient()
+		d.id.seq = dec.readSeq()
+		d.deleted = dec.readDeleteSet()
+		if dec.err != nil {
+			return nil
+		}
+		deletions = append(deletions, d)
+	}
+	return deletions
+}
+
+// writeItems encodes the items grouped by client, with clients in increasing order
+//
+// Items of a client are sorted by seq and must not overlap. The seq of an item is only written
+// when it does not follow the previous item of the client, and origins are written relative to the item
+func (enc *encoder) writeItems(items []Item) {
+	by_client := make(map[Client][]Item)
+	for _, item := range items {
+		by_client[item.id.client] = append(by_client[item.id.client], item)
+	}
+	enc.writeUvarint(uint64(len(by_client)))
+	for _, client := range sortedClients(by_client) {
+		client_items := by_client[client]
+		slices.SortFunc(client_items, func(a, b Item) int { return int(a.id.seq - b.id.seq) })
+		enc.writeClient(client)
+		enc.writeUvarint(uint64(len(client_items)))
+		var end Seq = 0
+		for _, item := range client_items {
+			enc.writeItem(item, end)
+			end = item.id.seq + Seq(item.length)
+		}
+	}
+}
+
+// writeItem encodes the item, given the end of the previous item of the same client
+func (enc *encoder) writeItem(item Item, end Seq) {
+	var info byte
+	if item.id.seq != end {
+		info |= flagSeqGap
+	}
+	if item.origin_left != nil {
+		info |= flagOriginLeft
+		if item.origin_left.client == item.id.client {
+			info |= flagOriginLeftSameClient
+			if item.origin_left.seq == item.id.seq-1 {
+				info |= flagOriginLeftPrevious
+			}
+		}
+	}
+	if item.origin_right != nil {
+		info |= flagOriginRight
+		if item.origin_right.client == item.id.client {
+			info |= flagOriginRightSameClient
+		}
+	}
+	if item.collected() {
+		info |= flagCollected
+	}
+	if item.embed != nil {
+		info |= flagEmbed
+	}
+	enc.writeByte(info)
+	if info&flagSeqGap != 0 {
+		enc.writeUvarint(uint64(item.id.seq - end))
+	}
+	if info&flagOriginLeft != 0 && info&flagOriginLeftPrevious == 0 {
+		enc.writeOrigin(*item.origin_left, item.id, info&flagOriginLeftSameClient != 0)
+	}
+	if info&flagOriginRight != 0 {
+		enc.writeOrigin(*item.origin_right, item.id, info&flagOriginRightSameClient != 0)
+	}
+	if info&flagCollected != 0 {
+		enc.writeUvarint(uint64(item.length))
+		return
+	}
+	if info&flagEmbed != 0 {
+		enc.writeString(string(item.embed))
+		return
+	}
+	enc.writeString(string(item.content))
+}
+
+// writeOrigin encodes the origin, relative to the item id if it is from the same client
+func (enc *encoder) writeOrigin(origin Id, id Id, same_client bool) {
+	if same_client {
+		enc.writeVarint(int64(id.seq - origin.seq))
+		return
+	}
+	enc.writeClient(origin.client)
+	enc.writeUvarint(uint64(origin.seq))
+}
+
+func (dec *decoder) readItems() []Item {
+	var items []Item
+	count := dec.readLength()
+	for range count {
+		client := dec.readClient()
+		client_count := dec.readLength()
+		var end Seq = 0
+		for range client_count {
+			item := dec.readItem(client, end)
+			if dec.err != nil {
+				return nil
+			}
+			items = append(items, item)
+			end = item.id.seq + Seq(item.length)
+		}
+	}
+	return items
+}
+
+// readItem decodes an item of the given client, given the end of its previous item
+func (dec *decoder) readItem(client Client, end Seq) Item {
+	info := dec.readByte()
+	item := Item{id: Id{client: client, seq: end}}
+	if info&flagSeqGap != 0 {
+		item.id.seq = dec.checkSeq(int64(end) + int64(dec.readSeq()))
+	}
+	if info&flagOriginLeft != 0 {
+		var origin_left Id
+		if info&flagOriginLeftPrevious != 0 {
+			origin_left = Id{client: client, seq: dec.checkSeq(int64(item.id.seq) - 1)}
+		} else {
+			origin_left = dec.readOrigin(item.id, info&flagOriginLeftSameClient != 0)
+		}
+		item.origin_left = &origin_left
+	}
+	if info&flagOriginRight != 0 {
+		origin_right := dec.readOrigin(item.id, info&flagOriginRightSameClient != 0)
+		item.origin_right = &origin_right
+	}
+	if info&flagCollected != 0 {
+		length := dec.readUvarint()
+		if dec.err == nil && (length == 0 || length > uint64(maxSeq)+1) {
+			dec.fail("invalid length %d of collected item", length)
+		}
+		item.length = int(length)
+	} else if info&flagEmbed != 0 {
+		item.embed = []byte(dec.readString())
+		if dec.err == nil && len(item.embed) == 0 {
+			dec.fail("embed payload must not be empty")
+		}
+		item.content = embedContent
+		item.length = 1
+	} else {
+		content := dec.readString()
+		if dec.err == nil && (content == "" || !utf8.ValidString(content)) {
+			dec.fail("item content must be non-empty UTF-8")
+		}
+		item.content = Content(content)
+		item.length = item.content.length()
+	}
+	if dec.err != nil {
+		return Item{}
+	}
+	if int64(item.id.seq)+int64(item.length)-1 > int64(maxSeq) {
+		dec.fail("item of length %d at seq %d out of range", item.length, item.id.seq)
+		return Item{}
+	}
+	return item
+}
+
+func (dec *decoder) readOrigin(id Id, same_client bool) Id {
+	if same_client {
+		return Id{client: id.client, seq: dec.checkSeq(int64(id.seq) - dec.readVarint())}
+	}
+	client := dec.readClient()
+	seq := dec.readSeq()
+	return Id{client: client, seq: seq}
+}
+
+// writeClientTable encodes every client of the update once, in increasing order,
+// so that the rest of the update refers to them by their index in the table
+func (enc *encoder) writeClientTable(upd *update) {
+	clients := make(map[Client]uint64)
+	for _, item := range upd.items {
+		clients[item.id.client] = 0
+		if item.origin_left != nil {
+			clients[item.origin_left.client] = 0
+		}
+		if item.origin_right != nil {
+			clients[item.origin_right.client] = 0
+		}
+	}
+	for client := range upd.deleted {
+		clients[client] = 0
+	}
+	for _, d := range upd.deletions {
+		clients[d.id.client] = 0
+		for client := range d.deleted {
+			clients[client] = 0
+		}
+	}
+	for _, m := range upd.marks {
+		clients[m.id.client] = 0
+		for _, anchor := range []*Id{m.start.id, m.end.id} {
+			if anchor != nil {
+				clients[anchor.client] = 0
+			}
+		}
+	}
+	for _, e := range upd.entries {
+		clients[e.id.client] = 0
+	}
+	for _, run := range upd.values {
+		clients[run.id.client] = 0
+	}
+	enc.writeUvarint(uint64(len(clients)))
+	for i, client := range sortedClients(clients) {
+		enc.writeUvarint(uint64(client))
+		clients[client] = uint64(i)
+	}
+	enc.clients = clients
+}
+
+func (dec *decoder) readClientTable() {
+	count := dec.readLength()
+	clients := make([]Client, 0, count)
+	for range count {
+		client := Client(dec.readUvarint())
+		if len(clients) > 0 && client <= clients[len(clients)-1] {
+			dec.fail("clients of the client table are not in increasing order")
+		}
+		if dec.err != nil {
+			return
+		}
+		clients = append(clients, client)
+	}
+	dec.clients = clients
+}
+
+func (enc *encoder) writeUpdate(upd *update) {
+	enc.writeClientTable(upd)
+	enc.writeItems(upd.items)
+	enc.writeDeleteSet(upd.deleted)
+	enc.writeDeletions(upd.deletions)
+	enc.writeMarks(upd.marks)
+	enc.writeEntries(upd.entries)
+	enc.writeValues(upd.values)
+}
+
+func (dec *decoder) readUpdate() *update {
+	upd := &update{}
+	dec.readClientTable()
+	upd.items = dec.readItems()
+	upd.deleted = dec.readDeleteSet()
+	upd.deletions = dec.readDeletions()
+	upd.marks = dec.readMarks()
+	upd.entries = dec.readEntries()
+	upd.values = dec.readValues()
+	if dec.err != nil {
+		return nil
+	}
+	return upd
+}
+
+// encodeVersion encodes the version as a state vector
+func encodeVersion(version Version) []byte {
+	enc := encoder{}
+	enc.writeByte(formatVersion)
+	enc.writeVersion(version)
+	return enc.buf
+}
+
+// decodeVersion decodes a state vector
+//
+// an empty state vector is decoded as an empty version
+func decodeVersion(data []byte) (Version, error) {
+	if len(data) == 0 {
+		return make(Version), nil
+	}
+	dec := decoder{buf: data}
+	dec.readFormatVersion()
+	version := dec.readVersion()
+	if err := dec.finish(); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// encodeUpdate encodes the update in its binary form
+func encodeUpdate(upd *update) []byte {
+	enc := encoder{}
+	enc.writeByte(formatVersion)
+	enc.writeUpdate(upd)
+	return enc.buf
+}
+
+// decodeUpdate decodes an update from its binary form
+func decodeUpdate(data []byte) (*update, error) {
+	dec := decoder{buf: data}
+	dec.readFormatVersion()
+	upd := dec.readUpdate()
+	if err := dec.finish(); err != nil {
+		return nil, err
+	}
+	return upd, nil
+}
+
+// DecodeStateVector decodes a state vector produced by EncodeStateVector
+//
+// returns an error if the state vector is malformed
+func DecodeStateVector(state_vector []byte) (Version, error) {
+	return decodeVersion(state_vector)
+}
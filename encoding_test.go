@@ -0,0 +1,159 @@
+package fugue
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenDocs returns two documents with concurrent inserts, deletes and multi-byte characters
+//
+// returns an error if the documents cannot be synced
+func goldenDocs() (*Doc, *Doc, error) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(200)
+	doc1.Insert(0, "Hello")
+	doc1.Insert(5, " world")
+	if err := doc2.Merge(doc1); err != nil {
+		return nil, nil, err
+	}
+	doc2.Insert(5, ",")
+	doc1.Insert(11, "!")
+	doc1.Delete(6, 5)
+	doc1.Insert(6, "wörld")
+	if err := doc2.Merge(doc1); err != nil {
+		return nil, nil, err
+	}
+	if err := doc1.Merge(doc2); err != nil {
+		return nil, nil, err
+	}
+	doc2.Insert(0, "零")
+	if err := doc1.Merge(doc2); err != nil {
+		return nil, nil, err
+	}
+	return doc1, doc2, nil
+}
+
+// checkGolden compares the data with the golden file, or rewrites it with the -update flag
+func checkGolden(t *testing.T, name string, data []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write golden file: %v", err)
+		}
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read golden file: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Encoding of %s changed:\n got  %x\n want %x", name, data, expected)
+	}
+}
+
+func TestEncodingGolden(t *testing.T) {
+	doc1, doc2, err := goldenDocs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc1.Text() != "零Hello, wörld!" || doc2.Text() != doc1.Text() {
+		t.Fatalf("Unexpected content: doc1='%s', doc2='%s'", doc1.Text(), doc2.Text())
+	}
+	checkGolden(t, "state_vector.golden", doc1.EncodeStateVector())
+	checkGolden(t, "update.golden", doc1.EncodeState())
+}
+
+func TestDecodingGolden(t *testing.T) {
+	read := func(name string) []byte {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("Failed to read golden file: %v", err)
+		}
+		return data
+	}
+	version, err := DecodeStateVector(read("state_vector.golden"))
+	if err != nil || len(version) != 2 || version[1] != 17 || version[200] != 1 {
+		t.Errorf("Unexpected state vector: %v %v", version, err)
+	}
+	doc := NewDocWithClient(3)
+	if err := doc.ApplyUpdate(read("update.golden")); err != nil {
+		t.Fatalf("Unexpected error applying golden update: %v", err)
+	}
+	if doc.Text() != "零Hello, wörld!" {
+		t.Errorf("Unexpected content: '%s'", doc.Text())
+	}
+	// Encoding the loaded document gives the same bytes
+	if update := read("update.golden"); !bytes.Equal(doc.EncodeState(), update) {
+		t.Errorf("Re-encoding changed the update:\n got  %x\n want %x", doc.EncodeState(), update)
+	}
+}
+
+func TestEncodingLargeClients(t *testing.T) {
+	doc1 := NewDocWithClient(1 << 63)
+	doc2 := NewDoc()
+	doc1.Insert(0, "abc")
+	syncDocs(t, doc1, doc2)
+	doc2.Insert(1, "d")
+	doc2.Delete(2, 1)
+	syncDocs(t, doc2, doc1)
+	if doc1.Text() != "adc" || doc2.Text() != doc1.Text() {
+		t.Errorf("Unexpected content: doc1='%s', doc2='%s'", doc1.Text(), doc2.Text())
+	}
+	// Every client is written once, however many items refer to it
+	for i := range 50 {
+		doc1.Insert(2*i, "x")
+	}
+	state := doc1.EncodeState()
+	if len(state) > doc1.Len()+6*50+2*10+20 {
+		t.Errorf("Encoding of %d characters takes %d bytes", doc1.Len(), len(state))
+	}
+}
+
+func TestEncodingCompact(t *testing.T) {
+	doc := NewDocWithClient(1)
+	for i := range 1000 {
+		doc.Insert(i, "a")
+		if i%10 == 9 {
+			doc.Delete(i-5, 1)
+		}
+	}
+	// Every item adds a few bytes of metadata to its content
+	state := doc.EncodeState()
+	if len(state) > doc.Len()+4*100+50 {
+		t.Errorf("Encoding of %d characters in %d items takes %d bytes", doc.Len(), doc.content.length, len(state))
+	}
+}
+
+func TestEncodingFormatVersion(t *testing.T) {
+	doc := NewDocWithClient(1)
+	doc.Insert(0, "abc")
+	update := doc.EncodeState()
+	update[0] = formatVersion + 1
+	if err := NewDocWithClient(2).ApplyUpdate(update); err == nil {
+		t.Errorf("Expected an error for an unknown format version")
+	}
+}
+
+func FuzzApplyUpdate(f *testing.F) {
+	doc1, _, err := goldenDocs()
+	if err != nil {
+		f.Fatalf("Unexpected error: %v", err)
+	}
+	f.Add(doc1.EncodeState())
+	f.Add(doc1.EncodeStateVector())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc := NewDocWithClient(3)
+		if doc.ApplyUpdate(data) == nil {
+			// A valid update can be encoded again
+			if _, err := decodeUpdate(doc.EncodeState()); err != nil {
+				t.Errorf("Failed to decode a re-encoded update: %v", err)
+			}
+		}
+	})
+}
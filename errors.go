@@ -1,4 +1,4 @@
-package main
+package fugue
 
 import (
 	"errors"
@@ -14,5 +14,16 @@ func (err *OutOfBoundErr) Error() string {
 }
 
 var (
-	ErrNotFound = errors.New("object not found")
+	ErrNotFound        = errors.New("object not found")
+	ErrInvalidEncoding = errors.New("invalid encoding")
+	ErrClientConflict  = errors.New("client used by several replicas with different histories")
+
+	// ErrCausalityViolation is returned for changes depending on changes that are not in the document
+	ErrCausalityViolation = errors.New("causality violation")
+	// ErrMalformedItem is returned for items whose fields are not consistent
+	ErrMalformedItem = errors.New("malformed item")
+	// ErrCollected is returned when reading content that was dropped by the GC
+	ErrCollected = errors.New("content collected")
+	// ErrContainerRoot is returned when a root of a container is synced on its own instead of with its container
+	ErrContainerRoot = errors.New("document is a root of a container")
 )
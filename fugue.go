@@ -0,0 +1,572 @@
+// Package fugue implements the Fugue sequence CRDT for collaborative text editing.
+//
+// A Doc is a replica of a shared text owned by a single Client. Local edits are
+// made with Insert and Delete, and replicas converge by merging their states.
+package fugue
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"sync"
+)
+
+// Version maps every known client to the last seq seen from it
+type Version map[Client]Seq
+
+// Doc is a replica of a collaborative text document
+//
+// A Doc can be used by several goroutines at once
+type Doc struct {
+	mu         *sync.RWMutex // guards the document and the state of its undo managers, shared by the roots of a container
+	client     Client        // the client owning the local edits of this replica
+	content    linkedList
+	version    Version
+	deleted    deleteSet       // ids of every deleted item, including the ones of items not received yet
+	deletions  map[Id]deletion // deletions by id, telling which client deleted the ids, see deleteset.go
+	deleted_by deleters        // ids of the deletions by the client that made them, see changes.go
+	unit       Unit            // unit of the positions and lengths of the public API
+	pending    []Item          // items received before the items they depend on, sorted by client and seq
+	marks      map[Id]mark     // formatting marks by id, see marks.go
+
+	pending_marks     []mark     // marks received before the previous seq of their client, sorted by client and seq
+	pending_deletions []deletion // deletions received before the previous seq of their client, sorted by client and seq
+
+	entries         map[Id]entry  // entries of the map by id, see map.go
+	keys            map[string]Id // id of the entry winning for every key of the map
+	pending_entries []entry       // entries received before the previous seq of their client, sorted by client and seq
+
+	elements elementValues // values of the elements of a sequence, nil for a text, see sequence.go
+
+	container *Container   // container the document is a root of, nil for a standalone document, see container.go
+	tx        *transaction // transaction running on the document, if any
+	observers []*observer
+	emit      *dispatcher // notifies the observers in the order of the transactions, see observe.go
+}
+
+// NewDoc creates an empty document whose local edits are made by a new random client
+func NewDoc() *Doc {
+	return NewDocWithClient(RandomClient())
+}
+
+// NewDocWithClient creates an empty document whose local edits are made by the given client
+//
+// Every replica editing the same document must use a different client
+func NewDocWithClient(client Client) *Doc {
+	return &Doc{
+		mu:         &sync.RWMutex{},
+		emit:       &dispatcher{},
+		client:     client,
+		content:    linkedList{},
+		version:    make(Version),
+		deleted:    make(deleteSet),
+		deletions:  make(map[Id]deletion),
+		deleted_by: make(deleters),
+		marks:      make(map[Id]mark),
+		entries:    make(map[Id]entry),
+		keys:       make(map[string]Id),
+	}
+}
+
+// RandomClient returns a new random client
+//
+// Clients are 64-bit, so replicas choosing their client at random practically never collide
+func RandomClient() Client {
+	return Client(rand.Uint64())
+}
+
+// Client returns the client owning the local edits of the document
+//
+// The client changes when a remote update contains edits made with it, see ApplyUpdate
+func (doc *Doc) Client() Client {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.client
+}
+
+// Text returns the visible text of the document
+func (doc *Doc) Text() string {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return string(doc.getContent())
+}
+
+// Len returns the length of the visible text of the document, in the unit of the document
+func (doc *Doc) Len() int {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.content.visibleLength(doc.unit)
+}
+
+// Version returns a copy of the version of the document
+func (doc *Doc) Version() Version {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return maps.Clone(doc.version)
+}
+
+// Insert inserts the text at the given position, counted in the unit of the document
+//
+// returns an error if the position is out of bounds
+func (doc *Doc) Insert(position int, text string) error {
+	if text == "" {
+		return nil
+	}
+	return doc.Transact(func(tx *Tx) error {
+		return tx.Insert(position, text)
+	})
+}
+
+// Delete deletes the text of the given length starting at the given position,
+// both counted in the unit of the document
+//
+// returns an error if the range is out of bounds
+func (doc *Doc) Delete(position int, length int) error {
+	return doc.Transact(func(tx *Tx) error {
+		return tx.Delete(position, length)
+	})
+}
+
+// Merge merges the content of the other document into this document
+//
+// The other document is only locked while its changes are collected, so that two documents
+// can be merged into each other at the same time.
+// returns an error if the merge fails,
+// or ErrContainerRoot if either document is a root of a container, which is synced with its container
+func (doc *Doc) Merge(from *Doc) error {
+	if from.container != nil {
+		return ErrContainerRoot
+	}
+	if from == doc {
+		return nil
+	}
+	version := doc.Version()
+	from.mu.RLock()
+	upd := from.diff(version)
+	from.mu.RUnlock()
+	return doc.transact(false, func() error {
+		return doc.applyUpdate(upd)
+	})
+}
+
+func (doc *Doc) getContent() Content {
+	var content Content = ""
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		if !(linked_item.item.deleted) {
+			content += linked_item.item.content
+		}
+	}
+	return content
+}
+
+// visibleRange calls the function with the visible items between the rune positions start and end,
+// in document order, and the part of their content in the range
+func (doc *Doc) visibleRange(start int, end int, fn func(linked_item *linkedItem, content Content)) {
+	linked_item, before := doc.content.find(UnitRune, func(before int, item_end int) bool { return item_end > start })
+	for position := before[UnitRune]; linked_item != nil && position < end; linked_item = linked_item.next {
+		if linked_item.item.deleted {
+			continue
+		}
+		content := linked_item.item.content
+		if position+linked_item.item.length > end {
+			content, _ = content.splitAt(end - position)
+		}
+		if position < start {
+			_, content = content.splitAt(start - position)
+		}
+		// An empty range still finds the item containing its position
+		if content != "" {
+			fn(linked_item, content)
+		}
+		position += linked_item.item.length
+	}
+}
+
+// findItemFromId finds the item in the list that contains the id
+//
+// returns the item and the position of the id in the document
+// returns an error if the item is not found
+// returns -1 if the item is nil
+func (doc *Doc) findItemFromId(id *Id) (*linkedItem, int, error) {
+	if id == nil {
+		return nil, -1, nil
+	}
+	linked_item, offset := doc.content.locate(*id)
+	if linked_item == nil {
+		return nil, -1, ErrNotFound
+	}
+	return linked_item, doc.content.sizeBefore(linked_item) + offset, nil
+}
+
+// findItemAt finds the item at the given position, ignoring deleted items
+//
+// returns the item and the relative position of the item inside the returned linked item
+// returns an error with the overflow if the position is out of bounds
+//
+// example: this function returns 'abc' as the item and position 1
+// if we call findItemAt(1, ...) on document {'abc'}
+func (doc *Doc) findItemAt(position int, stick_end bool) (*linkedItem, int, *OutOfBoundErr) {
+	if position < 0 {
+		return nil, -1, &OutOfBoundErr{position}
+	}
+	item, before := doc.content.find(UnitRune, func(before int, end int) bool {
+		// Deleted items have no visible characters, they are only found when sticking to the end
+		return end > position || (stick_end && before >= position)
+	})
+	if item == nil {
+		return nil, -1, &OutOfBoundErr{position - doc.content.visibleLength(UnitRune)}
+	}
+	return item, position - before[UnitRune], nil
+}
+
+// localInsert inserts the content at the given position for the given client,
+// or an embed if the payload is not nil
+//
+// returns an error if the position is out of bounds
+func (doc *Doc) localInsert(client Client, position int, content Content, embed []byte) error {
+	if position < 0 {
+		return fmt.Errorf("position must be greater than 0")
+	}
+	var origin_left *Id = nil
+	var origin_right *Id = nil
+	item, item_position, err := doc.findItemAt(position, true)
+	if err != nil && err.overflow > 0 {
+		// Overflow of 0 means that we are at the end of the document
+		// We only allow insertions before or at the end of the document
+		return fmt.Errorf("item not found: %w", err)
+	}
+	seq := doc.nextSeq(client)
+	// Find the left and right origins
+	if item == nil {
+		if doc.content.tail != nil {
+			// We insert at the end of the document
+			last_id := doc.content.tail.idAt(doc.content.tail.length() - 1)
+			origin_left = &last_id
+		}
+		// We don't need to set the origin_right if we are at the end of the document
+	} else {
+		// We insert in the document
+		origin_right = &Id{
+			client: item.item.id.client,
+			seq:    item.item.id.seq + Seq(item_position),
+		}
+		if item_position == 0 {
+			// We insert at the beginning of the item
+			if item.prev != nil {
+				// We insert after some item
+				prev_id := item.prev.idAt(item.prev.length() - 1) // the right most item of the previous item
+				origin_left = &prev_id
+			}
+			// We don't need to set the origin_left if we are at the beginning of the document
+		} else {
+			// We insert in the middle of the item
+			origin_left = &Id{
+				client: item.item.id.client,
+				seq:    item.item.id.seq + Seq(item_position-1),
+			}
+		}
+	}
+	return doc.integrate(Item{
+		id: Id{
+			client,
+			seq,
+		},
+		origin_left:  origin_left,
+		origin_right: origin_right,
+		deleted:      false,
+		content:      content,
+		length:       content.length(),
+		embed:        embed,
+	})
+}
+
+// nextSeq returns the seq of the next item created by the client
+func (doc *Doc) nextSeq(client Client) Seq {
+	if seq, ok := doc.version[client]; ok {
+		return seq + 1
+	}
+	return 0
+}
+
+// insertAfterId inserts the content right after the character with the given id,
+// whether this character is deleted or not, or an embed if the payload is not nil
+//
+// returns an error if the id is not in the document
+func (doc *Doc) insertAfterId(client Client, id Id, content Content, embed []byte) error {
+	linked_item, offset := doc.content.locate(id)
+	if linked_item == nil {
+		return fmt.Errorf("origin_left not found: %w", ErrNotFound)
+	}
+	// The origins are the character and the one right after it, as for a local insertion
+	var origin_right *Id = nil
+	if offset < linked_item.length()-1 {
+		next_id := linked_item.idAt(offset + 1)
+		origin_right = &next_id
+	} else if linked_item.next != nil {
+		origin_right = &Id{client: linked_item.next.item.id.client, seq: linked_item.next.item.id.seq}
+	}
+	origin_left := id
+	return doc.integrate(Item{
+		id:           Id{client: client, seq: doc.nextSeq(client)},
+		origin_left:  &origin_left,
+		origin_right: origin_right,
+		content:      content,
+		length:       content.length(),
+		embed:        embed,
+	})
+}
+
+// localDelete deletes the content at the given position for the given length
+//
+// returns an error if the position is out of bounds
+// returns an error if the length is negative or greater than the length of the document
+func (doc *Doc) localDelete(position int, length int) error {
+	if length <= 0 {
+		return fmt.Errorf("length must be greater than 0")
+	}
+	item, item_position, err := doc.findItemAt(position, false)
+	if err != nil {
+		return fmt.Errorf("item not found: %w", err)
+	}
+	// If we start deleting in the middle of a non-deleted item, we need to split the item
+	// The left part of the item will be kept
+	// The right part of the item will be deleted
+	if !item.item.deleted && item_position > 0 {
+		_, right_split, err := doc.content.splitTwo(item, item_position)
+		if err != nil {
+			return fmt.Errorf("delete error: %w", err)
+		}
+		item = right_split
+	}
+
+	for length > 0 && item != nil {
+		if !item.item.deleted {
+			// We only care about the non-deleted items
+			if length >= item.item.length {
+				// We can delete the whole item
+				doc.markDeleted(item)
+				length -= item.item.length
+				// See if we can merge the item with the previous item
+				if item.canMergeLeft() {
+					doc.content.mergeLeft(item)
+					// Move to the previous item, so that we can do merging in both directions
+					item = item.prev
+				}
+				// See if we can merge the item with the next item
+				if item.canMergeRight() {
+					doc.content.mergeRight(item)
+				}
+			} else {
+				// We need to split the last item to delete a part of it
+				left, _, err := doc.content.splitTwo(item, length)
+				if err != nil {
+					return fmt.Errorf("delete error: %w", err)
+				}
+				doc.markDeleted(left)
+				//See if we can merge the left part of the split with the previous item
+				if left.canMergeLeft() {
+					doc.content.mergeLeft(left)
+				}
+				return nil
+			}
+		}
+		// Move to the next item, we still have work to do
+		item = item.next
+	}
+	// If length > 0, it means we ran out of items to delete
+	if length > 0 {
+		return errors.New("not enough items to delete")
+	}
+
+	return nil
+}
+
+// cropOutVersion crops the item to remove the part that is already in the version
+//
+// returns the cropped item and an error if the item is fully in the version
+func cropOutVersion(item Item, version *Version) (Item, error) {
+	if seq, ok := (*version)[item.id.client]; ok {
+		if seq >= item.id.seq+Seq(item.length-1) {
+			// The item is fully in the version
+			return Item{}, errors.New("item is fully in the version")
+		}
+		if seq < item.id.seq {
+			// The item is fully out of the version
+			return item, nil
+		}
+		// The item is partially in the version
+		crop := item
+		_, crop.content = item.content.splitAt(int(seq - item.id.seq + 1))
+		crop.length = item.length - int(seq-item.id.seq+1)
+		crop.id.seq = seq + 1
+		crop.origin_left = &Id{
+			client: item.id.client,
+			seq:    seq,
+		}
+		return crop, nil
+	}
+	return item, nil
+}
+
+// isInVersion checks if the id is in the version
+//
+// returns true if the id is nil or is in the version
+func isInVersion(id *Id, version *Version) bool {
+	if id == nil {
+		return true
+	}
+	// An id is in the version if we have seen a greater id from the same client before
+	if seq, ok := (*version)[id.client]; ok {
+		return id.seq <= seq
+	}
+	return false
+}
+
+// missingDependency finds an id the item depends on that is not in the version
+//
+// returns the client of the missing id and true if the item cannot be inserted yet
+func missingDependency(item Item, version *Version) (Client, bool) {
+	// Check if the items related to the given item are in the version
+	if item.id.seq > 0 && !isInVersion(&Id{client: item.id.client, seq: item.id.seq - 1}, version) {
+		return item.id.client, true
+	}
+	if !isInVersion(item.origin_left, version) {
+		return item.origin_left.client, true
+	}
+	if !isInVersion(item.origin_right, version) {
+		return item.origin_right.client, true
+	}
+	return 0, false
+}
+
+// integrate integrates the item in the document
+//
+// The document is only modified once the item is known to be integrable.
+// returns ErrCausalityViolation if the item does not follow the last item of its client
+// or if its origins are not in the document
+func (doc *Doc) integrate(item Item) error {
+	id := item.id
+	if val, ok := doc.version[id.client]; (!ok && id.seq != 0) || (ok && id.seq != val+1) {
+		// The item seq needs to be in order
+		return fmt.Errorf("%w: item %d:%d does not follow the last item of its client", ErrCausalityViolation, id.client, id.seq)
+	}
+	// The item may be placed among tombstones folded by the GC, see gc.go
+	doc.content.unfoldOrigins(item)
+	left_item, left_index, err := doc.findItemFromId(item.origin_left)
+	if err != nil {
+		return fmt.Errorf("%w: origin_left not found: %w", ErrCausalityViolation, err)
+	}
+	var dest_item *linkedItem = doc.content.head
+	var position = 0
+	if left_item != nil {
+		_, position = doc.content.locate(*item.origin_left)
+		dest_item = left_item
+		// We will place the item after the left item
+		position++
+		if position > left_item.length()-1 {
+			// Go to the next item if we were already at the end of the left item
+			dest_item = dest_item.next
+			position = 0
+		}
+	}
+	var right_item *linkedItem = nil
+	right_index := doc.content.count
+	if item.origin_right != nil {
+		right_item, right_index, err = doc.findItemFromId(item.origin_right)
+		if err != nil {
+			return fmt.Errorf("%w: origin_right not found: %w", ErrCausalityViolation, err)
+		}
+	}
+	scanning := false
+	dest_position := position
+	for other := dest_item; ; other = other.next {
+		if !scanning {
+			dest_item = other
+			dest_position = position
+		}
+		if other == nil || other == right_item {
+			break
+		}
+		if len(other.folded) > 0 {
+			// Every folded tombstone has its own origins
+			doc.content.unfold(other)
+		}
+		// Inside an item, the origin_left of a character is always the previous character,
+		// which is the origin_left of the item being integrated
+		oleft_index := left_index
+		if position == 0 {
+			_, oleft_index, err = doc.findItemFromId(other.item.origin_left)
+			if err != nil {
+				return fmt.Errorf("origin_left not found: %w", err)
+			}
+		}
+		oright_index := doc.content.count
+		if other.item.origin_right != nil {
+			_, oright_index, err = doc.findItemFromId(other.item.origin_right)
+			if err != nil {
+				return fmt.Errorf("origin_right not found: %w", err)
+			}
+		}
+		if oleft_index < left_index || (oleft_index == left_index && oright_index == right_index && item.id.client < other.item.id.client) {
+			break
+		}
+		if oleft_index == left_index {
+			scanning = oright_index < right_index
+		}
+		// Search at the beginning of every new item
+		position = 0
+	}
+	// The version also increase with the length of the item
+	doc.version[id.client] = id.seq + Seq(item.length-1)
+	if doc.tx != nil {
+		doc.tx.inserted.add(id.client, id.seq, item.length)
+	}
+	if dest_item == nil {
+		// We insert at the end of the list
+		doc.content.insertAfter(doc.content.tail, item)
+		if doc.content.tail.canMergeLeft() {
+			// The new tail can be merged with the previous item
+			doc.content.mergeLeft(doc.content.tail)
+		}
+		return doc.deleteIntegrated(item)
+	}
+	// We insert in the rest of the list
+	_, middle, _, err := doc.content.insertAt(dest_item, dest_position, item)
+	if err != nil {
+		return fmt.Errorf("error inserting item: %w", err)
+	}
+	if middle.canMergeLeft() {
+		doc.content.mergeLeft(middle)
+	}
+	return doc.deleteIntegrated(item)
+}
+
+// equals checks if the two ids are equal
+//
+// returns true if the ids are equal
+func (id1 *Id) equals(id2 *Id) bool {
+	return id1 == id2 || (id1 != nil && id2 != nil && id1.client == id2.client && id1.seq == id2.seq)
+}
+
+// canMergeLeft checks if the item can be merged with the previous item
+//
+// returns true if the item can be merged
+func (at *linkedItem) canMergeLeft() bool {
+	// We can merge if the item is the continuation of the previous item
+	return at != nil && at.prev != nil && at.prev.item.deleted == at.item.deleted && // both items are deleted or not
+		at.prev.item.collected() == at.item.collected() && // both items have their content or none
+		at.prev.item.embed == nil && at.item.embed == nil && // embeds always stay alone
+		at.prev.folded == nil && at.folded == nil && // folded tombstones stay after the item of their node
+		at.prev.item.origin_right.equals(at.item.origin_right) && // in case new item is placed at the left of a merged item
+		at.prev.item.id.client == at.item.id.client && // if the item is from the same client
+		at.prev.item.id.seq+Seq(at.prev.item.length) == at.item.id.seq
+}
+
+// canMergeRight checks if the item can be merged with the next item
+//
+// returns true if the item can be merged
+func (at *linkedItem) canMergeRight() bool {
+	// We just use the next item to check if we can merge on the left
+	return at != nil && at.next.canMergeLeft()
+}
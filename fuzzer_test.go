@@ -1,9 +1,11 @@
-package main
+package fugue_test
 
 import (
 	"math"
 	"math/rand"
 	"testing"
+
+	fugue "github.com/seercle/fugue-crdt"
 )
 
 func TestFuzzer(t *testing.T) {
@@ -12,27 +14,27 @@ func TestFuzzer(t *testing.T) {
 	chars_len := len(chars)
 	for i := range trials {
 		rng := rand.New(rand.NewSource(i))
-		docs := []*Doc{newDoc(), newDoc(), newDoc()}
+		docs := []*fugue.Doc{fugue.NewDocWithClient(0), fugue.NewDocWithClient(1), fugue.NewDocWithClient(2)}
 		for range 1000 {
 			for range len(docs) {
 				i := rng.Intn(len(docs))
 				doc := docs[i]
-				len := doc.content.length
+				len := doc.Len()
 				var weight float32 = 0.65
 				if len > 10 {
 					weight = 0.35
 				}
-				if doc.content.length == 0 || rng.Float32() < weight {
+				if len == 0 || rng.Float32() < weight {
 					//insert
 					position := rng.Intn(len + 1)
 					rune := chars[rng.Intn(chars_len)]
 					//t.Logf("%d %d %s", i, position, string(rune))
-					doc.localInsert(Client(i), position, Content(rune))
+					doc.Insert(position, string(rune))
 				} else {
 					//delete
 					position := rng.Intn(len + 1)
 					length := rng.Intn(int(math.Min(float64(len-position+1), float64(3))))
-					doc.localDelete(position, length)
+					doc.Delete(position, length)
 				}
 			}
 		}
@@ -42,23 +44,26 @@ func TestFuzzer(t *testing.T) {
 		doc1 := docs[0]
 		doc2 := docs[1]
 		// Merge doc1 into doc2
-		err := doc1.mergeFrom(doc2)
+		err := doc1.Merge(doc2)
 		if err != nil {
 			t.Errorf("Unexpected error during merge: %v", err)
 		}
-		err = doc2.mergeFrom(doc1)
+		err = doc2.Merge(doc1)
 		if err != nil {
 			t.Errorf("Unexpected error during merge: %v", err)
 		}
 		// Check if the merged content is consistent
-		if doc1.getContent() != doc2.getContent() {
-			t.Errorf("Trial %d after merge: doc1='%s', doc2='%s'", i, doc1.getContent(), doc2.getContent())
+		if doc1.Text() != doc2.Text() {
+			t.Errorf("Trial %d after merge: doc1='%s', doc2='%s'", i, doc1.Text(), doc2.Text())
 		}
+		// A replica loading the encoded state of a document sees the same text
 		for j := range len(docs) {
-			for item := docs[j].content.head; item != nil; item = item.next {
-				if item.item.content == "" {
-					t.Errorf("Trial %d: empty content in doc %d", i, j)
-				}
+			loaded := fugue.NewDocWithClient(3)
+			if err := loaded.ApplyUpdate(docs[j].EncodeState()); err != nil {
+				t.Errorf("Trial %d: unexpected error loading doc %d: %v", i, j, err)
+			}
+			if loaded.Text() != docs[j].Text() || loaded.Len() != docs[j].Len() {
+				t.Errorf("Trial %d: loaded '%s', doc %d='%s'", i, loaded.Text(), j, docs[j].Text())
 			}
 		}
 	}
@@ -0,0 +1,237 @@
+package fugue
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Deleted items stay in the document as tombstones, since concurrent items can use them as origins.
+// Once every replica has a deleted item, no replica will ever ask for its content again,
+// so the content is dropped and only the ids, origins and length of the item are kept.
+// A run of collected tombstones is then folded into the node of its first tombstone: the other tombstones
+// leave the list, the tree and the id index, and only keep their ids, origins and length in the node,
+// with an index of their own so that the items using them as origins are still found.
+// An item is only placed among folded tombstones if it was created concurrently with their deletion,
+// so integrate restores them as nodes in that rare case, and the next GC folds them again.
+// The values of the elements of a sequence are dropped along with their placeholder content.
+
+// foldedItem is a collected tombstone folded into the node of a tombstone before it in the list
+type foldedItem struct {
+	id           Id
+	origin_left  *Id
+	origin_right *Id
+	length       int
+	node         *linkedItem // node the tombstone is folded into
+	offset       int         // length of the node before the tombstone
+}
+
+// GC drops the content of the deleted items that every replica has
+//
+// stable must be a version that every replica has reached, such as the MinVersion of their state vectors.
+// The ids and origins of the tombstones are kept, so that the items created concurrently with the deletions
+// are still integrated at the same place on every replica, but the collected content cannot be
+// sent to replicas missing it anymore, nor restored by an UndoManager, nor read by ContentAt.
+// Runs of collected tombstones are folded into a single node, so the list and the tree keep a node
+// per run of deleted characters, however they were typed. The collected ids are dropped from the deletions
+// in the stable version, so Changes cannot tell who deleted them anymore.
+func (doc *Doc) GC(stable Version) error {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		item := linked_item.item
+		if item.deleted && !item.collected() && isInVersion(&item.id, &stable) {
+			if end := stable[item.id.client]; end < item.id.seq+Seq(item.length-1) {
+				// Only the part of the item that every replica has is collected
+				left, _, err := doc.content.splitTwo(linked_item, int(end-item.id.seq+1))
+				if err != nil {
+					return fmt.Errorf("error splitting tombstone: %w", err)
+				}
+				linked_item = left
+			}
+			doc.content.collect(linked_item)
+			if doc.elements != nil {
+				doc.elements.drop(linked_item.item.id.client, seqRange{start: linked_item.item.id.seq, length: linked_item.item.length})
+			}
+		}
+		if !linked_item.tombstone() || !linked_item.prev.tombstone() {
+			continue
+		}
+		prev := linked_item.prev
+		if linked_item.canMergeLeft() {
+			if err := doc.content.mergeLeft(linked_item); err != nil {
+				return fmt.Errorf("error merging tombstones: %w", err)
+			}
+		} else {
+			doc.content.fold(linked_item)
+		}
+		linked_item = prev
+	}
+	collected := make(deleteSet)
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		if linked_item.tombstone() {
+			for _, item := range linked_item.items() {
+				collected.add(item.id.client, item.id.seq, item.length)
+			}
+		}
+	}
+	doc.pruneDeletions(stable, collected)
+	return nil
+}
+
+// MinVersion returns the version that every given version has reached,
+// with the clients known by all of them and the smallest of their seqs
+func MinVersion(versions ...Version) Version {
+	stable := make(Version)
+	if len(versions) == 0 {
+		return stable
+	}
+	for client, seq := range versions[0] {
+		stable[client] = seq
+		for _, version := range versions[1:] {
+			other, ok := version[client]
+			if !ok {
+				delete(stable, client)
+				break
+			}
+			stable[client] = min(stable[client], other)
+		}
+	}
+	return stable
+}
+
+// collected checks if the content of the item was dropped by the GC
+func (item *Item) collected() bool {
+	return item.content == "" && item.length > 0
+}
+
+// collect drops the content of the deleted item, keeping its ids, origins and length
+//
+// Deleted items are not part of the visible lengths of the tree, so the tree stays unchanged
+func (list *linkedList) collect(at *linkedItem) {
+	at.item.content = ""
+	at.item.embed = nil
+	at.counts = lengths{}
+}
+
+// tombstone checks if the node is a collected tombstone, which can be folded
+func (node *linkedItem) tombstone() bool {
+	return node != nil && node.item.deleted && node.item.collected()
+}
+
+// item returns the folded tombstone as a collected item
+func (f *foldedItem) item() Item {
+	return Item{id: f.id, origin_left: f.origin_left, origin_right: f.origin_right, deleted: true, length: f.length}
+}
+
+// length returns the length of the item of the node and of the tombstones folded into it
+func (node *linkedItem) length() int {
+	if len(node.folded) == 0 {
+		return node.item.length
+	}
+	last := node.folded[len(node.folded)-1]
+	return last.offset + last.length
+}
+
+// items returns the item of the node followed by the tombstones folded into it, in the order of the list
+func (node *linkedItem) items() []Item {
+	items := make([]Item, 0, 1+len(node.folded))
+	items = append(items, node.item)
+	for _, f := range node.folded {
+		items = append(items, f.item())
+	}
+	return items
+}
+
+// idAt returns the id of the character at the offset in the node
+func (node *linkedItem) idAt(offset int) Id {
+	if offset < node.item.length {
+		return Id{client: node.item.id.client, seq: node.item.id.seq + Seq(offset)}
+	}
+	i := sort.Search(len(node.folded), func(i int) bool { return node.folded[i].offset > offset }) - 1
+	return Id{client: node.folded[i].id.client, seq: node.folded[i].id.seq + Seq(offset-node.folded[i].offset)}
+}
+
+// fold folds the collected tombstone at 'at', and the tombstones folded into it, into the node before it
+//
+// Warning: the node before must be a collected tombstone too
+func (list *linkedList) fold(at *linkedItem) {
+	host := at.prev
+	tombstones := append([]*foldedItem{{
+		id:           at.item.id,
+		origin_left:  at.item.origin_left,
+		origin_right: at.item.origin_right,
+		length:       at.item.length,
+	}}, at.folded...)
+	for _, f := range at.folded {
+		list.foldedRemove(f)
+	}
+	// Update the count of the list, this change will be counterbalanced by the deletion
+	list.count += at.length()
+	list.delete(at)
+	for _, f := range tombstones {
+		// A tombstone continuing the last folded one is merged with it, as for the items of the list
+		if n := len(host.folded); n > 0 {
+			last := host.folded[n-1]
+			if last.id.client == f.id.client && last.id.seq+Seq(last.length) == f.id.seq && last.origin_right.equals(f.origin_right) {
+				last.length += f.length
+				continue
+			}
+		}
+		f.node, f.offset = host, host.length()
+		host.folded = append(host.folded, f)
+		list.foldedAdd(f)
+	}
+	list.fixUp(host)
+}
+
+// unfold restores the tombstones folded into the node as nodes of their own, right after it
+func (list *linkedList) unfold(node *linkedItem) {
+	folded := node.folded
+	node.folded = nil
+	list.fixUp(node)
+	at := node
+	for _, f := range folded {
+		list.foldedRemove(f)
+		// Update the count of the list, this change will be counterbalanced by the insertion
+		list.count -= f.length
+		list.insertAfter(at, f.item())
+		at = at.next
+	}
+}
+
+// unfoldOrigins restores the tombstones folded with the origins of the item as nodes,
+// unless the item is placed right after or right before their node, so that integrate can place it among them
+func (list *linkedList) unfoldOrigins(item Item) {
+	if item.origin_left != nil {
+		if node, offset := list.locate(*item.origin_left); node != nil && offset < node.length()-1 {
+			list.unfold(node)
+		}
+	}
+	if item.origin_right != nil {
+		if node, offset := list.locate(*item.origin_right); node != nil && offset > 0 {
+			list.unfold(node)
+		}
+	}
+}
+
+// checkCollected checks that the ids of a collected item are in one of the delete sets,
+// since its content cannot be shown
+//
+// returns ErrMalformedItem if some of its ids are not deleted
+func checkCollected(item Item, delete_sets ...deleteSet) error {
+	if !item.collected() {
+		return nil
+	}
+	missing := []seqRange{{start: item.id.seq, length: item.length}}
+	for _, ds := range delete_sets {
+		var rest []seqRange
+		for _, r := range missing {
+			rest = append(rest, ds.complement(item.id.client, r.start, r.length)...)
+		}
+		missing = rest
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: collected item %d:%d is not deleted", ErrMalformedItem, item.id.client, item.id.seq)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package fugue
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// checkAllCollected checks that every deleted item of the document in the stable version has been collected
+func checkAllCollected(t *testing.T, doc *Doc, stable Version) {
+	t.Helper()
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		item := linked_item.item
+		if item.deleted && isInVersion(&item.id, &stable) && !item.collected() {
+			t.Fatalf("Tombstone %d:%d has not been collected", item.id.client, item.id.seq)
+		}
+		if item.collected() && !item.deleted {
+			t.Fatalf("Visible item %d:%d has been collected", item.id.client, item.id.seq)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello world")
+	syncDocs(t, doc1, doc2)
+	um, _ := newTestUndoManager(doc1)
+	doc1.Delete(3, 5)
+	doc1.Delete(0, 1)
+	// doc2 inserts concurrently between characters that are deleted
+	doc2.Insert(5, "XX")
+	syncDocs(t, doc1, doc2)
+	stable := MinVersion(doc1.Version(), doc2.Version())
+	if err := doc1.GC(stable); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkAllCollected(t, doc1, stable)
+	checkTree(t, &doc1.content)
+	// The concurrent insert still finds its origins among the tombstones
+	syncDocs(t, doc2, doc1)
+	if doc1.Text() != "elXXrld" || doc2.Text() != doc1.Text() {
+		t.Fatalf("Unexpected content: '%s' and '%s'", doc1.Text(), doc2.Text())
+	}
+	// Tombstones are sent without their content
+	doc3 := NewDocWithClient(3)
+	if err := doc3.ApplyUpdate(doc1.EncodeState()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkAllCollected(t, doc3, stable)
+	data, err := json.Marshal(doc1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	loaded := NewDocWithClient(4)
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc3.Text() != doc1.Text() || loaded.Text() != doc1.Text() {
+		t.Errorf("Unexpected content: '%s' and '%s'", doc3.Text(), loaded.Text())
+	}
+	// The collected content cannot be restored
+	if err := um.Undo(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc1.Text() != "elXXrld" {
+		t.Errorf("Unexpected content after undo: '%s'", doc1.Text())
+	}
+	// A collected item must be deleted
+	upd := encodeUpdate(&update{items: []Item{{id: Id{client: 5, seq: 0}, length: 3}}, deleted: make(deleteSet)})
+	if err := NewDocWithClient(6).ApplyUpdate(upd); !errors.Is(err, ErrMalformedItem) {
+		t.Errorf("Unexpected error for a collected item that is not deleted: %v", err)
+	}
+}
+
+func TestSplitCollected(t *testing.T) {
+	// A collected item has no content to walk through, however long it is
+	deleted := make(deleteSet)
+	deleted.add(1, 0, 1<<30)
+	left, right := Id{client: 1, seq: 1 << 29}, Id{client: 1, seq: 1<<29 + 1}
+	upd := encodeUpdate(&update{
+		items: []Item{
+			{id: Id{client: 1, seq: 0}, length: 1 << 30},
+			{id: Id{client: 2, seq: 0}, origin_left: &left, origin_right: &right, content: "a", length: 1},
+		},
+		deleted: deleted,
+	})
+	doc := NewDocWithClient(3)
+	if err := doc.ApplyUpdate(upd); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkTree(t, &doc.content)
+	if doc.Text() != "a" || doc.content.length != 3 {
+		t.Errorf("Unexpected content '%s' in %d items", doc.Text(), doc.content.length)
+	}
+}
+
+func TestGCFoldsTombstones(t *testing.T) {
+	forwards := NewDocWithClient(1)
+	backwards := NewDocWithClient(2)
+	for i := range 200 {
+		forwards.Insert(i, "a")
+		backwards.Insert(0, "a")
+	}
+	for _, doc := range []*Doc{forwards, backwards} {
+		doc.Delete(0, 200)
+		if err := doc.GC(doc.Version()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		checkTree(t, &doc.content)
+	}
+	if forwards.content.length != 1 || backwards.content.length != 1 {
+		t.Errorf("Unexpected nodes %d and %d", forwards.content.length, backwards.content.length)
+	}
+	// Typing after the folded tombstones does not restore them
+	backwards.Insert(0, "b")
+	if backwards.content.length != 2 || backwards.Text() != "b" {
+		t.Errorf("Unexpected content '%s' in %d nodes", backwards.Text(), backwards.content.length)
+	}
+}
+
+func TestGCFoldedOrigins(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	reference := NewDocWithClient(3)
+	for range 10 {
+		doc1.Insert(0, "a")
+	}
+	syncDocs(t, doc1, doc2)
+	stable := MinVersion(doc1.Version(), doc2.Version())
+	// doc2 inserts concurrently in the middle of characters typed backwards, which doc1 deletes
+	doc2.Insert(5, "X")
+	doc2.Insert(8, "Y")
+	doc1.Delete(0, 10)
+	syncDocs(t, doc1, reference)
+	syncDocs(t, doc2, reference)
+	if err := doc1.GC(stable); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc1.content.length != 1 {
+		t.Errorf("Unexpected nodes %d", doc1.content.length)
+	}
+	// The folded tombstones are restored to place the concurrent inserts, and folded again by the next GC
+	syncDocs(t, doc2, doc1)
+	checkTree(t, &doc1.content)
+	if doc1.Text() != "XY" || doc1.Text() != reference.Text() {
+		t.Errorf("Unexpected content '%s', expected '%s'", doc1.Text(), reference.Text())
+	}
+	if err := doc1.GC(stable); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkTree(t, &doc1.content)
+	if doc1.content.length != 5 {
+		t.Errorf("Unexpected nodes %d", doc1.content.length)
+	}
+	// The folded tombstones are sent to other replicas with their origins
+	loaded := NewDocWithClient(4)
+	if err := loaded.ApplyUpdate(doc1.EncodeState()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	syncDocs(t, doc1, reference)
+	syncDocs(t, reference, loaded)
+	if loaded.Text() != reference.Text() || reference.Text() != "XY" {
+		t.Errorf("Unexpected content '%s', expected '%s'", loaded.Text(), reference.Text())
+	}
+}
+
+func TestMinVersion(t *testing.T) {
+	stable := MinVersion(Version{1: 4, 2: 7, 3: 1}, Version{1: 6, 2: 3}, Version{1: 5, 2: 3, 4: 0})
+	if len(stable) != 2 || stable[1] != 4 || stable[2] != 3 {
+		t.Errorf("Unexpected version %v", stable)
+	}
+	if len(MinVersion()) != 0 {
+		t.Errorf("Unexpected version for no versions")
+	}
+}
+
+func TestGCFuzzer(t *testing.T) {
+	const trials int64 = 50
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		// The same edits are made on documents that are never collected
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		references := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		for range 200 {
+			j := rng.Intn(len(docs))
+			randomEdit(t, rng, docs[j], references[j])
+			if rng.Float32() < 0.3 {
+				k := rng.Intn(len(docs))
+				syncDocs(t, docs[j], docs[k])
+				syncDocs(t, references[j], references[k])
+			}
+			if rng.Float32() < 0.1 {
+				versions := make([]Version, len(docs))
+				for k, doc := range docs {
+					versions[k] = doc.Version()
+				}
+				stable := MinVersion(versions...)
+				k := rng.Intn(len(docs))
+				if err := docs[k].GC(stable); err != nil {
+					t.Fatalf("Trial %d: unexpected error: %v", i, err)
+				}
+				checkAllCollected(t, docs[k], stable)
+				checkTree(t, &docs[k].content)
+			}
+			for k := range docs {
+				if docs[k].Text() != references[k].Text() {
+					t.Fatalf("Trial %d: doc %d='%s', expected '%s'", i, k, docs[k].Text(), references[k].Text())
+				}
+			}
+		}
+	}
+}
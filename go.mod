@@ -1,3 +1,3 @@
-module fugue/v0
+module github.com/seercle/fugue-crdt
 
 go 1.24.2
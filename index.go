@@ -0,0 +1,135 @@
+package fugue
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+)
+
+// The list keeps for every client its items sorted by seq, so that the item containing an id
+// is found with a binary search instead of a scan of the whole list.
+// Items of a client never overlap, and splits and merges keep them sorted.
+// The tombstones folded by the GC have an index of their own, pointing to the node they are folded into.
+
+// compareSeq compares the first seq of the item with the seq
+func compareSeq(node *linkedItem, seq Seq) int {
+	return cmp.Compare(node.item.id.seq, seq)
+}
+
+// indexAdd adds the item to the index of its client
+func (list *linkedList) indexAdd(node *linkedItem) {
+	if list.ids == nil {
+		list.ids = make(map[Client][]*linkedItem)
+	}
+	client := node.item.id.client
+	i, _ := slices.BinarySearchFunc(list.ids[client], node.item.id.seq, compareSeq)
+	list.ids[client] = slices.Insert(list.ids[client], i, node)
+}
+
+// indexRemove removes the item from the index of its client
+func (list *linkedList) indexRemove(node *linkedItem) {
+	client := node.item.id.client
+	if i, found := slices.BinarySearchFunc(list.ids[client], node.item.id.seq, compareSeq); found {
+		list.ids[client] = slices.Delete(list.ids[client], i, i+1)
+	}
+}
+
+// itemsIn returns the items of the client holding ids of the range, sorted by seq
+func (list *linkedList) itemsIn(client Client, r seqRange) []*linkedItem {
+	items := list.ids[client]
+	// The first item is the last one starting at or before the range, if it reaches the range
+	i := max(sort.Search(len(items), func(i int) bool { return items[i].item.id.seq > r.start })-1, 0)
+	if i < len(items) && items[i].item.id.seq+Seq(items[i].item.length) <= r.start {
+		i++
+	}
+	j := sort.Search(len(items), func(j int) bool { return items[j].item.id.seq >= r.end() })
+	if i >= j {
+		return nil
+	}
+	return items[i:j]
+}
+
+// nextSeq returns the first seq of the first item of the client of the id starting after the id
+//
+// returns end if there is no such item before end
+func (list *linkedList) nextSeq(id Id, end Seq) Seq {
+	items := list.ids[id.client]
+	i := sort.Search(len(items), func(i int) bool { return items[i].item.id.seq > id.seq })
+	if i == len(items) {
+		return end
+	}
+	return min(items[i].item.id.seq, end)
+}
+
+// findId finds the item containing the id
+//
+// returns nil if no item contains the id
+func (list *linkedList) findId(id Id) *linkedItem {
+	items := list.ids[id.client]
+	// The item containing the id is the last one starting at or before it
+	i := sort.Search(len(items), func(i int) bool { return items[i].item.id.seq > id.seq }) - 1
+	if i < 0 || id.seq >= items[i].item.id.seq+Seq(items[i].item.length) {
+		return nil
+	}
+	return items[i]
+}
+
+// compareFolded compares the first seq of the folded tombstone with the seq
+func compareFolded(f *foldedItem, seq Seq) int {
+	return cmp.Compare(f.id.seq, seq)
+}
+
+// foldedAdd adds the folded tombstone to the index of its client
+func (list *linkedList) foldedAdd(f *foldedItem) {
+	if list.folded == nil {
+		list.folded = make(map[Client][]*foldedItem)
+	}
+	i, _ := slices.BinarySearchFunc(list.folded[f.id.client], f.id.seq, compareFolded)
+	list.folded[f.id.client] = slices.Insert(list.folded[f.id.client], i, f)
+}
+
+// foldedRemove removes the folded tombstone from the index of its client
+func (list *linkedList) foldedRemove(f *foldedItem) {
+	if i, found := slices.BinarySearchFunc(list.folded[f.id.client], f.id.seq, compareFolded); found {
+		list.folded[f.id.client] = slices.Delete(list.folded[f.id.client], i, i+1)
+	}
+}
+
+// findFolded finds the folded tombstone containing the id
+//
+// returns nil if no folded tombstone contains the id
+func (list *linkedList) findFolded(id Id) *foldedItem {
+	folded := list.folded[id.client]
+	i := sort.Search(len(folded), func(i int) bool { return folded[i].id.seq > id.seq }) - 1
+	if i < 0 || id.seq >= folded[i].id.seq+Seq(folded[i].length) {
+		return nil
+	}
+	return folded[i]
+}
+
+// locate finds the node containing the id, in its item or in a tombstone folded into it
+//
+// returns the node and the offset of the id in the node
+// returns nil if no node contains the id
+func (list *linkedList) locate(id Id) (*linkedItem, int) {
+	if node := list.findId(id); node != nil {
+		return node, int(id.seq - node.item.id.seq)
+	}
+	if f := list.findFolded(id); f != nil {
+		return f.node, f.offset + int(id.seq-f.id.seq)
+	}
+	return nil, -1
+}
+
+// itemOf returns the item or the folded tombstone containing the id
+//
+// returns false if no node contains the id
+func (list *linkedList) itemOf(id Id) (Item, bool) {
+	if node := list.findId(id); node != nil {
+		return node.item, true
+	}
+	if f := list.findFolded(id); f != nil {
+		return f.item(), true
+	}
+	return Item{}, false
+}
@@ -0,0 +1,44 @@
+package fugue
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestIdIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1)}
+	for range 2000 {
+		doc := docs[rng.Intn(len(docs))]
+		if rng.Float32() < 0.05 {
+			docs[0].Merge(docs[1])
+			docs[1].Merge(docs[0])
+		} else {
+			randomEdit(t, rng, doc)
+		}
+		// Every id of the version must be found in its item, at its index in the list
+		index := 0
+		count := 0
+		for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+			id := linked_item.item.id
+			for offset := range linked_item.item.length {
+				found, found_index, err := doc.findItemFromId(&Id{client: id.client, seq: id.seq + Seq(offset)})
+				if err != nil || found != linked_item || found_index != index {
+					t.Fatalf("Id %v found at %d, expected %d: %v", id, found_index, index, err)
+				}
+				index++
+			}
+			count++
+		}
+		indexed := 0
+		for _, items := range doc.content.ids {
+			indexed += len(items)
+		}
+		if indexed != count {
+			t.Fatalf("The index has %d items, the list has %d", indexed, count)
+		}
+		if _, _, err := doc.findItemFromId(&Id{client: 2, seq: 0}); err != ErrNotFound {
+			t.Fatalf("Unexpected error for an unknown id: %v", err)
+		}
+	}
+}
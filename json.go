@@ -0,0 +1,475 @@
+package fugue
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+)
+
+// jsonId is the JSON form of an Id
+type jsonId struct {
+	Client Client `json:"client"`
+	Seq    Seq    `json:"seq"`
+}
+
+// jsonItem is the JSON form of an Item
+type jsonItem struct {
+	Id          Id     `json:"id"`
+	OriginLeft  *Id    `json:"origin_left"`
+	OriginRight *Id    `json:"origin_right"`
+	Content     string `json:"content"`
+	Length      int    `json:"length,omitempty"` // length of the item when its content was collected
+	Embed       []byte `json:"embed,omitempty"`  // payload of an embed, in base64
+	Deleted     bool   `json:"deleted"`
+}
+
+// jsonRange is the JSON form of a range of deleted seqs
+type jsonRange struct {
+	Seq    Seq `json:"seq"`
+	Length int `json:"length"`
+}
+
+// jsonPosition is the JSON form of a RelativePosition
+type jsonPosition struct {
+	Id    *Id   `json:"id"`
+	Assoc Assoc `json:"assoc"`
+}
+
+// jsonMark is the JSON form of a mark
+type jsonMark struct {
+	Id    Id           `json:"id"`
+	Clock Seq          `json:"clock"`
+	Name  string       `json:"name"`
+	Value string       `json:"value"`
+	Start jsonPosition `json:"start"`
+	End   jsonPosition `json:"end"`
+}
+
+// jsonDeletion is the JSON form of a deletion
+type jsonDeletion struct {
+	Id      Id        `json:"id"`
+	Deleted deleteSet `json:"deleted"`
+}
+
+// jsonEntry is the JSON form of an entry of the map
+type jsonEntry struct {
+	Id          Id     `json:"id"`
+	Clock       Seq    `json:"clock"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	Removed     bool   `json:"removed,omitempty"`
+	Overwritten bool   `json:"overwritten,omitempty"`
+}
+
+// jsonValues is the JSON form of a run of values of the elements of a sequence
+type jsonValues struct {
+	Id     Id                `json:"id"`
+	Values []json.RawMessage `json:"values"`
+}
+
+// jsonUpdate is the JSON form of an update
+type jsonUpdate struct {
+	Items     []Item       `json:"items"`
+	Deleted   deleteSet    `json:"deleted"`
+	Deletions []deletion   `json:"deletions,omitempty"`
+	Marks     []mark       `json:"marks,omitempty"`
+	Entries   []entry      `json:"entries,omitempty"`
+	Values    []encodedRun `json:"values,omitempty"`
+}
+
+// jsonDoc is the JSON form of a document
+type jsonDoc struct {
+	Client    Client     `json:"client"`
+	Version   Version    `json:"version"`
+	Deleted   deleteSet  `json:"deleted"`
+	Deletions []deletion `json:"deletions,omitempty"` // deletions telling who deleted the ids, sorted by client and seq
+	Items     []Item     `json:"items"`               // items in document order, including deleted ones
+	Pending   []Item     `json:"pending,omitempty"`   // items waiting for the items they depend on
+	Marks     []mark     `json:"marks,omitempty"`     // formatting marks, from the oldest to the newest
+	Entries   []entry    `json:"entries,omitempty"`   // entries of the map, sorted by client and seq
+
+	PendingEntries   []entry    `json:"pending_entries,omitempty"`   // entries waiting for the previous seq of their client
+	PendingMarks     []mark     `json:"pending_marks,omitempty"`     // marks waiting for the previous seq of their client
+	PendingDeletions []deletion `json:"pending_deletions,omitempty"` // deletions waiting for the previous seq of their client
+}
+
+// MarshalJSON encodes the id as {"client": ..., "seq": ...}
+func (id Id) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonId{Client: id.client, Seq: id.seq})
+}
+
+// UnmarshalJSON decodes an id encoded by MarshalJSON
+func (id *Id) UnmarshalJSON(data []byte) error {
+	var decoded jsonId
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.Seq < 0 || decoded.Seq > maxSeq {
+		return fmt.Errorf("%w: seq %d out of range", ErrInvalidEncoding, decoded.Seq)
+	}
+	id.client = decoded.Client
+	id.seq = decoded.Seq
+	return nil
+}
+
+// MarshalJSON encodes the item with its id, origins, content and deleted flag,
+// and its length instead of its content if it was collected
+func (item Item) MarshalJSON() ([]byte, error) {
+	encoded := jsonItem{
+		Id:          item.id,
+		OriginLeft:  item.origin_left,
+		OriginRight: item.origin_right,
+		Content:     string(item.content),
+		Embed:       item.embed,
+		Deleted:     item.deleted,
+	}
+	if item.collected() {
+		encoded.Length = item.length
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes an item encoded by MarshalJSON
+//
+// returns an error if the content is empty without a length or is not valid UTF-8
+func (item *Item) UnmarshalJSON(data []byte) error {
+	var decoded jsonItem
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if (decoded.Content == "") == (decoded.Length <= 0) || !utf8.ValidString(decoded.Content) {
+		return fmt.Errorf("%w: item content must be non-empty UTF-8, or be collected with a length", ErrInvalidEncoding)
+	}
+	*item = Item{
+		id:           decoded.Id,
+		origin_left:  decoded.OriginLeft,
+		origin_right: decoded.OriginRight,
+		deleted:      decoded.Deleted,
+		content:      Content(decoded.Content),
+		length:       decoded.Length,
+		embed:        decoded.Embed,
+	}
+	if !item.collected() {
+		item.length = item.content.length()
+	}
+	if !validEmbed(*item) {
+		return fmt.Errorf("%w: embed must have a payload and a single character", ErrInvalidEncoding)
+	}
+	if item.id.seq+Seq(item.length-1) > maxSeq {
+		return fmt.Errorf("%w: item of length %d at seq %d out of range", ErrInvalidEncoding, item.length, item.id.seq)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the mark with its id, clock, attribute and anchors
+func (m mark) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMark{
+		Id:    m.id,
+		Clock: m.clock,
+		Name:  m.name,
+		Value: m.value,
+		Start: jsonPosition{Id: m.start.id, Assoc: m.start.assoc},
+		End:   jsonPosition{Id: m.end.id, Assoc: m.end.assoc},
+	})
+}
+
+// UnmarshalJSON decodes a mark encoded by MarshalJSON
+//
+// returns an error if the name is empty, if the clock is out of range or if the anchors are invalid
+func (m *mark) UnmarshalJSON(data []byte) error {
+	var decoded jsonMark
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.Clock < 0 || decoded.Clock > maxSeq {
+		return fmt.Errorf("%w: clock %d of mark %v out of range", ErrInvalidEncoding, decoded.Clock, decoded.Id)
+	}
+	*m = mark{
+		id:    decoded.Id,
+		clock: decoded.Clock,
+		name:  decoded.Name,
+		value: decoded.Value,
+		start: RelativePosition{id: decoded.Start.Id, assoc: decoded.Start.Assoc},
+		end:   RelativePosition{id: decoded.End.Id, assoc: decoded.End.Assoc},
+	}
+	for _, assoc := range []Assoc{m.start.assoc, m.end.assoc} {
+		if assoc != AssocLeft && assoc != AssocRight {
+			return fmt.Errorf("%w: unknown assoc %d", ErrInvalidEncoding, assoc)
+		}
+	}
+	if !validMark(*m) {
+		return fmt.Errorf("%w: invalid mark %v", ErrInvalidEncoding, m.id)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the deletion with its id and the ids it deleted
+func (d deletion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonDeletion{Id: d.id, Deleted: d.deleted})
+}
+
+// UnmarshalJSON decodes a deletion encoded by MarshalJSON
+func (d *deletion) UnmarshalJSON(data []byte) error {
+	var decoded jsonDeletion
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.Deleted == nil {
+		decoded.Deleted = make(deleteSet)
+	}
+	*d = deletion{id: decoded.Id, deleted: decoded.Deleted}
+	return nil
+}
+
+// MarshalJSON encodes the entry with its id, clock, key and value
+func (e entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonEntry{
+		Id:          e.id,
+		Clock:       e.clock,
+		Key:         e.key,
+		Value:       e.value,
+		Removed:     e.removed,
+		Overwritten: e.overwritten,
+	})
+}
+
+// UnmarshalJSON decodes an entry encoded by MarshalJSON
+//
+// returns an error if the key is empty or if an entry without a value has one
+func (e *entry) UnmarshalJSON(data []byte) error {
+	var decoded jsonEntry
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*e = entry{
+		id:          decoded.Id,
+		clock:       decoded.Clock,
+		key:         decoded.Key,
+		value:       decoded.Value,
+		removed:     decoded.Removed,
+		overwritten: decoded.Overwritten,
+	}
+	if !validEntry(*e) {
+		return fmt.Errorf("%w: invalid entry %v", ErrInvalidEncoding, e.id)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the run of values with the id of its first value
+func (run encodedRun) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonValues{Id: run.id, Values: run.values})
+}
+
+// UnmarshalJSON decodes a run of values encoded by MarshalJSON
+//
+// returns an error if the run is empty or goes past the last seq
+func (run *encodedRun) UnmarshalJSON(data []byte) error {
+	var decoded jsonValues
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if len(decoded.Values) == 0 || int64(decoded.Id.seq)+int64(len(decoded.Values)) > int64(maxSeq)+1 {
+		return fmt.Errorf("%w: invalid values at %v", ErrInvalidEncoding, decoded.Id)
+	}
+	*run = encodedRun{id: decoded.Id, values: decoded.Values}
+	return nil
+}
+
+// MarshalJSON encodes the delete set as a list of ranges for every client
+func (ds deleteSet) MarshalJSON() ([]byte, error) {
+	ranges := make(map[Client][]jsonRange, len(ds))
+	for client, client_ranges := range ds {
+		for _, r := range client_ranges {
+			ranges[client] = append(ranges[client], jsonRange{Seq: r.start, Length: r.length})
+		}
+	}
+	return json.Marshal(ranges)
+}
+
+// UnmarshalJSON decodes a delete set encoded by MarshalJSON
+func (ds *deleteSet) UnmarshalJSON(data []byte) error {
+	var ranges map[Client][]jsonRange
+	if err := json.Unmarshal(data, &ranges); err != nil {
+		return err
+	}
+	decoded := make(deleteSet)
+	for client, client_ranges := range ranges {
+		for _, r := range client_ranges {
+			if r.Seq < 0 || r.Length <= 0 || r.Seq+Seq(r.Length-1) > maxSeq {
+				return fmt.Errorf("%w: invalid deleted range of length %d at %d", ErrInvalidEncoding, r.Length, r.Seq)
+			}
+			decoded.add(client, r.Seq, r.Length)
+		}
+	}
+	*ds = decoded
+	return nil
+}
+
+// MarshalJSON encodes the whole state of the document, including deleted items
+func (doc *Doc) MarshalJSON() ([]byte, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	items := make([]Item, 0, doc.content.length)
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		items = append(items, linked_item.items()...)
+	}
+	return json.Marshal(jsonDoc{
+		Client:    doc.client,
+		Version:   doc.version,
+		Deleted:   doc.deleted,
+		Deletions: doc.sortedDeletions(),
+		Items:     items,
+		Pending:   doc.pending,
+		Marks:     doc.sortedMarks(),
+		Entries:   doc.sortedEntries(),
+
+		PendingEntries:   doc.pending_entries,
+		PendingMarks:     doc.pending_marks,
+		PendingDeletions: doc.pending_deletions,
+	})
+}
+
+// UnmarshalJSON replaces the state of the document with a state encoded by MarshalJSON
+//
+// returns an error if the items are not consistent with the version and the delete set,
+// or ErrContainerRoot if the document is a root of a container, which shares its version with the other roots
+func (doc *Doc) UnmarshalJSON(data []byte) error {
+	if doc.container != nil {
+		return ErrContainerRoot
+	}
+	var decoded jsonDoc
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.Version == nil {
+		decoded.Version = make(Version)
+	}
+	for client, seq := range decoded.Version {
+		if seq < 0 || seq > maxSeq {
+			return fmt.Errorf("%w: seq %d of client %d out of range", ErrInvalidEncoding, seq, client)
+		}
+	}
+	if decoded.Deleted == nil {
+		decoded.Deleted = make(deleteSet)
+	}
+	loaded := NewDocWithClient(decoded.Client)
+	loaded.version = decoded.Version
+	loaded.deleted = decoded.Deleted
+	// Every id of the version must be in exactly one item
+	seen := make(deleteSet)
+	counts := make(map[Client]int)
+	for _, item := range decoded.Items {
+		id := item.id
+		if !isInVersion(&Id{client: id.client, seq: id.seq + Seq(item.length-1)}, &loaded.version) ||
+			!isInVersion(item.origin_left, &loaded.version) || !isInVersion(item.origin_right, &loaded.version) {
+			return fmt.Errorf("%w: item %v is not in the version", ErrInvalidEncoding, id)
+		}
+		if len(seen.intersect(id.client, id.seq, item.length)) > 0 {
+			return fmt.Errorf("%w: item %v overlaps another item", ErrInvalidEncoding, id)
+		}
+		deleted := loaded.deleted.intersect(id.client, id.seq, item.length)
+		if item.deleted != (len(deleted) > 0) || (item.deleted && deleted[0].length != item.length) || (item.collected() && !item.deleted) {
+			return fmt.Errorf("%w: item %v does not match the delete set", ErrInvalidEncoding, id)
+		}
+		seen.add(id.client, id.seq, item.length)
+		counts[id.client] += item.length
+		loaded.content.insertAfter(loaded.content.tail, item)
+	}
+	for _, e := range decoded.Entries {
+		if !isInVersion(&e.id, &loaded.version) || seen.contains(e.id) {
+			return fmt.Errorf("%w: entry %v is not in the version or overlaps another entry", ErrInvalidEncoding, e.id)
+		}
+		seen.add(e.id.client, e.id.seq, 1)
+		counts[e.id.client]++
+		loaded.addEntry(e)
+	}
+	for _, m := range decoded.Marks {
+		if !isInVersion(&m.id, &loaded.version) || seen.contains(m.id) {
+			return fmt.Errorf("%w: mark %v is not in the version or overlaps another change", ErrInvalidEncoding, m.id)
+		}
+		seen.add(m.id.client, m.id.seq, 1)
+		counts[m.id.client]++
+		loaded.marks[m.id] = m
+	}
+	for _, d := range decoded.Deletions {
+		if !isInVersion(&d.id, &loaded.version) || seen.contains(d.id) {
+			return fmt.Errorf("%w: deletion %v is not in the version or overlaps another change", ErrInvalidEncoding, d.id)
+		}
+		seen.add(d.id.client, d.id.seq, 1)
+		counts[d.id.client]++
+		loaded.deletions[d.id] = d
+		loaded.deleted_by.merge(d.id.client, d.deleted)
+	}
+	for client, seq := range loaded.version {
+		if counts[client] != int(seq)+1 {
+			return fmt.Errorf("%w: missing items of client %d", ErrInvalidEncoding, client)
+		}
+	}
+	for _, item := range decoded.Pending {
+		if err := validateItem(item); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidEncoding, err)
+		}
+		if err := checkCollected(item, loaded.deleted); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidEncoding, err)
+		}
+		item.deleted = false
+		loaded.pending = append(loaded.pending, item)
+	}
+	slices.SortFunc(decoded.PendingEntries, compareEntryIds)
+	loaded.pending_entries = slices.CompactFunc(decoded.PendingEntries, func(a, b entry) bool { return a.id == b.id })
+	slices.SortFunc(decoded.PendingMarks, compareMarkIds)
+	loaded.pending_marks = slices.CompactFunc(decoded.PendingMarks, func(a, b mark) bool { return a.id == b.id })
+	slices.SortFunc(decoded.PendingDeletions, compareDeletionIds)
+	loaded.pending_deletions = slices.CompactFunc(decoded.PendingDeletions, func(a, b deletion) bool { return a.id == b.id })
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	doc.client = loaded.client
+	doc.content = loaded.content
+	doc.version = loaded.version
+	doc.deleted = loaded.deleted
+	doc.deletions = loaded.deletions
+	doc.deleted_by = loaded.deleted_by
+	doc.pending_deletions = loaded.pending_deletions
+	doc.pending = loaded.pending
+	doc.marks = loaded.marks
+	doc.pending_marks = loaded.pending_marks
+	doc.entries = loaded.entries
+	doc.keys = loaded.keys
+	doc.pending_entries = loaded.pending_entries
+	return nil
+}
+
+// UpdateToJSON converts a binary update into its human readable JSON form
+//
+// returns an error if the update is malformed
+func UpdateToJSON(data []byte) ([]byte, error) {
+	upd, err := decodeUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonUpdate{Items: upd.items, Deleted: upd.deleted, Deletions: upd.deletions, Marks: upd.marks, Entries: upd.entries, Values: upd.values})
+}
+
+// UpdateFromJSON converts the JSON form of an update back into a binary update
+//
+// returns an error if the JSON is malformed
+func UpdateFromJSON(data []byte) ([]byte, error) {
+	var decoded jsonUpdate
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	if decoded.Deleted == nil {
+		decoded.Deleted = make(deleteSet)
+	}
+	seen := make(deleteSet)
+	for i, item := range decoded.Items {
+		if len(seen.intersect(item.id.client, item.id.seq, item.length)) > 0 {
+			return nil, fmt.Errorf("%w: item %v overlaps another item", ErrInvalidEncoding, item.id)
+		}
+		seen.add(item.id.client, item.id.seq, item.length)
+		// Deletions are carried by the delete set
+		decoded.Items[i].deleted = false
+	}
+	return encodeUpdate(&update{items: decoded.Items, deleted: decoded.Deleted, deletions: decoded.Deletions, marks: decoded.Marks, entries: decoded.Entries, values: decoded.Values}), nil
+}
@@ -0,0 +1,101 @@
+package fugue
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestItemJSON(t *testing.T) {
+	item := Item{
+		id:           Id{client: 1, seq: 4},
+		origin_left:  &Id{client: 2, seq: 0},
+		origin_right: nil,
+		deleted:      true,
+		content:      "wörld",
+		length:       5,
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `{"id":{"client":1,"seq":4},"origin_left":{"client":2,"seq":0},"origin_right":null,"content":"wörld","deleted":true}`
+	if string(data) != expected {
+		t.Errorf("Unexpected JSON:\n got  %s\n want %s", data, expected)
+	}
+	var decoded Item
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.id != item.id || !decoded.origin_left.equals(item.origin_left) || decoded.origin_right != nil ||
+		decoded.content != item.content || decoded.length != item.length || !decoded.deleted {
+		t.Errorf("Unexpected decoded item: %+v", decoded)
+	}
+	if err := json.Unmarshal([]byte(`{"id":{"client":1,"seq":0},"content":""}`), &decoded); err == nil {
+		t.Errorf("Expected an error for an empty item")
+	}
+}
+
+func TestDocJSON(t *testing.T) {
+	doc1, doc2, err := goldenDocs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := json.Marshal(doc1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	loaded := NewDocWithClient(9)
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if loaded.Text() != doc1.Text() || loaded.Client() != doc1.Client() {
+		t.Errorf("Unexpected loaded document: '%s' for client %d", loaded.Text(), loaded.Client())
+	}
+	// Loading keeps the items as they were, so the JSON form does not change
+	if reencoded, _ := json.Marshal(loaded); string(reencoded) != string(data) {
+		t.Errorf("Unexpected JSON after loading:\n got  %s\n want %s", reencoded, data)
+	}
+	// The loaded document keeps syncing like the original one
+	doc2.Insert(doc2.Len(), "?")
+	syncDocs(t, doc2, loaded)
+	syncDocs(t, loaded, doc2)
+	if loaded.Text() != doc2.Text() {
+		t.Errorf("Unexpected content after sync: loaded='%s', doc2='%s'", loaded.Text(), doc2.Text())
+	}
+}
+
+func TestDocJSONInvalid(t *testing.T) {
+	for _, data := range []string{
+		// item not in the version
+		`{"client":1,"version":{},"deleted":{},"items":[{"id":{"client":1,"seq":0},"content":"a"}]}`,
+		// missing items
+		`{"client":1,"version":{"1":3},"deleted":{},"items":[{"id":{"client":1,"seq":0},"content":"a"}]}`,
+		// overlapping items
+		`{"client":1,"version":{"1":1},"deleted":{},"items":[{"id":{"client":1,"seq":0},"content":"ab"},{"id":{"client":1,"seq":1},"content":"b"}]}`,
+		// deleted flag not matching the delete set
+		`{"client":1,"version":{"1":0},"deleted":{},"items":[{"id":{"client":1,"seq":0},"content":"a","deleted":true}]}`,
+	} {
+		if err := json.Unmarshal([]byte(data), NewDocWithClient(1)); err == nil {
+			t.Errorf("Expected an error for %s", data)
+		}
+	}
+}
+
+func TestUpdateJSON(t *testing.T) {
+	doc1, _, err := goldenDocs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := UpdateToJSON(doc1.EncodeState())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	update, err := UpdateFromJSON(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	doc := NewDocWithClient(3)
+	if err := doc.ApplyUpdate(update); err != nil || doc.Text() != doc1.Text() {
+		t.Errorf("Unexpected content from JSON update: '%s' %v", doc.Text(), err)
+	}
+}
@@ -0,0 +1,157 @@
+package fugue
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lines are separated by '\n' and numbered from 0. Columns are counted in the unit of the document.
+// Every item caches its number of newlines, so that lines are found in O(log n) like positions.
+
+// LineCount returns the number of lines of the document, which is at least 1
+func (doc *Doc) LineCount() int {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.content.visibleLength(unitNewline) + 1
+}
+
+// Line returns the text of the line, without its newline
+//
+// returns an error if the line does not exist
+func (doc *Doc) Line(line int) (string, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	start, end, err := doc.lineRange(line)
+	if err != nil {
+		return "", err
+	}
+	start, _ = doc.toRunes(start)
+	end, _ = doc.toRunes(end)
+	var sb strings.Builder
+	doc.visibleRange(start, end, func(_ *linkedItem, content Content) {
+		sb.WriteString(string(content))
+	})
+	return sb.String(), nil
+}
+
+// Position returns the position of the column of the line
+//
+// returns an error if the line does not exist or the column is beyond the end of the line
+func (doc *Doc) Position(line int, column int) (int, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.position(line, column)
+}
+
+// LineColumn returns the line and the column of the position
+//
+// returns an error if the position is out of bounds or inside a character
+func (doc *Doc) LineColumn(position int) (line int, column int, err error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	runes, err := doc.toRunes(position)
+	if err != nil {
+		return -1, -1, err
+	}
+	// Count the newlines before the position
+	item, before := doc.content.find(UnitRune, func(before int, end int) bool { return end > runes })
+	line = doc.content.visibleLength(unitNewline)
+	if item != nil {
+		prefix, _ := item.item.content.splitAt(runes - before[UnitRune])
+		line = before[unitNewline] + strings.Count(string(prefix), "\n")
+	}
+	start, _, err := doc.lineRange(line)
+	if err != nil {
+		return -1, -1, err
+	}
+	return line, position - start, nil
+}
+
+// InsertAt inserts the text at the column of the line
+//
+// returns an error if the line does not exist or the column is beyond the end of the line
+func (doc *Doc) InsertAt(line int, column int, text string) error {
+	return doc.Transact(func(tx *Tx) error {
+		return tx.InsertAt(line, column, text)
+	})
+}
+
+// DeleteAt deletes the text of the given length starting at the column of the line,
+// the length can span several lines
+//
+// returns an error if the line does not exist or the range is out of bounds
+func (doc *Doc) DeleteAt(line int, column int, length int) error {
+	return doc.Transact(func(tx *Tx) error {
+		return tx.DeleteAt(line, column, length)
+	})
+}
+
+// InsertAt inserts the text at the column of the line
+//
+// returns an error if the line does not exist or the column is beyond the end of the line
+func (tx *Tx) InsertAt(line int, column int, text string) error {
+	position, err := tx.doc.position(line, column)
+	if err != nil {
+		return err
+	}
+	return tx.Insert(position, text)
+}
+
+// DeleteAt deletes the text of the given length starting at the column of the line,
+// the length can span several lines
+//
+// returns an error if the line does not exist or the range is out of bounds
+func (tx *Tx) DeleteAt(line int, column int, length int) error {
+	position, err := tx.doc.position(line, column)
+	if err != nil {
+		return err
+	}
+	return tx.Delete(position, length)
+}
+
+// position returns the position of the column of the line
+//
+// returns an error if the line does not exist or the column is beyond the end of the line
+func (doc *Doc) position(line int, column int) (int, error) {
+	start, end, err := doc.lineRange(line)
+	if err != nil {
+		return -1, err
+	}
+	if column < 0 || start+column > end {
+		return -1, fmt.Errorf("column %d of line %d: %w", column, line, &OutOfBoundErr{start + column - end})
+	}
+	return start + column, nil
+}
+
+// lineRange returns the positions of the start of the line and of its end, before its newline
+//
+// returns an error if the line does not exist
+func (doc *Doc) lineRange(line int) (int, int, error) {
+	lines := doc.content.visibleLength(unitNewline) + 1
+	if line < 0 || line >= lines {
+		return -1, -1, fmt.Errorf("line %d: %w", line, &OutOfBoundErr{line - lines})
+	}
+	start := 0
+	if line > 0 {
+		start = doc.newlineEnd(line - 1)
+	}
+	end := doc.content.visibleLength(doc.unit)
+	if line < lines-1 {
+		// The end of the line is right before its newline
+		end = doc.newlineEnd(line) - 1
+	}
+	return start, end, nil
+}
+
+// newlineEnd returns the position right after the newline with the given index,
+// which must be in the document
+func (doc *Doc) newlineEnd(index int) int {
+	item, before := doc.content.find(unitNewline, func(before int, end int) bool { return end > index })
+	// Find the newline in the content of the item
+	content := string(item.item.content)
+	offset := 0
+	for range index - before[unitNewline] + 1 {
+		offset += strings.IndexByte(content[offset:], '\n') + 1
+	}
+	return before[doc.unit] + doc.unitLength(Content(content[:offset]))
+}
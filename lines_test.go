@@ -0,0 +1,135 @@
+package fugue
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestLines(t *testing.T) {
+	doc := NewDocWithClient(1)
+	doc.Insert(0, "first\nsecond\n\nlast")
+	if doc.LineCount() != 4 {
+		t.Fatalf("Unexpected line count %d, expected 4", doc.LineCount())
+	}
+	for i, expected := range []string{"first", "second", "", "last"} {
+		if line, err := doc.Line(i); err != nil || line != expected {
+			t.Errorf("Unexpected line %d: '%s' %v, expected '%s'", i, line, err, expected)
+		}
+	}
+	if err := doc.InsertAt(1, 6, "!"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := doc.InsertAt(2, 0, "third"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc.Text() != "first\nsecond!\nthird\nlast" {
+		t.Fatalf("Unexpected content: '%s'", doc.Text())
+	}
+	// Deleting a newline joins the lines
+	if err := doc.DeleteAt(0, 5, 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc.LineCount() != 3 || doc.Text() != "firstsecond!\nthird\nlast" {
+		t.Fatalf("Unexpected content: '%s'", doc.Text())
+	}
+	if line, column, err := doc.LineColumn(15); err != nil || line != 1 || column != 2 {
+		t.Errorf("Unexpected line and column %d:%d %v, expected 1:2", line, column, err)
+	}
+	if position, err := doc.Position(2, 4); err != nil || position != 23 {
+		t.Errorf("Unexpected position %d %v, expected 23", position, err)
+	}
+	// Lines and columns out of bounds are rejected
+	var out_of_bound *OutOfBoundErr
+	if _, err := doc.Position(3, 0); !errors.As(err, &out_of_bound) {
+		t.Errorf("Unexpected error for a line out of bounds: %v", err)
+	}
+	if err := doc.InsertAt(1, 6, "x"); !errors.As(err, &out_of_bound) {
+		t.Errorf("Unexpected error for a column out of bounds: %v", err)
+	}
+	// Columns are counted in the unit of the document
+	doc.SetUnit(UnitUTF16)
+	doc.InsertAt(2, 0, "😀")
+	if position, err := doc.Position(2, 2); err != nil || position != 21 {
+		t.Errorf("Unexpected position %d %v, expected 21", position, err)
+	}
+	if line, column, err := doc.LineColumn(25); err != nil || line != 2 || column != 6 {
+		t.Errorf("Unexpected line and column %d:%d %v, expected 2:6", line, column, err)
+	}
+}
+
+func TestLinesFuzzer(t *testing.T) {
+	const trials int64 = 50
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1)}
+		for _, doc := range docs {
+			doc.SetUnit(UnitUTF16)
+		}
+		for range 200 {
+			j := rng.Intn(len(docs))
+			doc := docs[j]
+			if rng.Float32() < 0.4 {
+				// Edit a random line before one of its characters or at its end
+				lines := strings.Split(doc.Text(), "\n")
+				line := rng.Intn(len(lines))
+				columns := []int{0}
+				for _, r := range lines[line] {
+					columns = append(columns, columns[len(columns)-1]+utf16.RuneLen(r))
+				}
+				c := rng.Intn(len(columns))
+				if rng.Float32() < 0.6 {
+					// Break the line, or insert a character in it
+					text := "\n"
+					if rng.Float32() < 0.5 {
+						text = string(fuzzChars[rng.Intn(len(fuzzChars))])
+					}
+					if err := doc.InsertAt(line, columns[c], text); err != nil {
+						t.Fatalf("Trial %d: unexpected error: %v", i, err)
+					}
+				} else if c < len(columns)-1 || line < len(lines)-1 {
+					// Delete the character at the column, or the newline at the end of the line
+					length := 1
+					if c < len(columns)-1 {
+						length = columns[c+1] - columns[c]
+					}
+					if err := doc.DeleteAt(line, columns[c], length); err != nil {
+						t.Fatalf("Trial %d: unexpected error: %v", i, err)
+					}
+				}
+			} else {
+				randomEdit(t, rng, doc)
+			}
+			if rng.Float32() < 0.2 {
+				syncDocs(t, doc, docs[1-j])
+			}
+			for k, doc := range docs {
+				checkLines(t, doc, strings.Split(doc.Text(), "\n"), k)
+			}
+		}
+	}
+}
+
+// checkLines checks the lines of the document and the conversions between positions and lines and columns
+func checkLines(t *testing.T, doc *Doc, lines []string, k int) {
+	t.Helper()
+	if doc.LineCount() != len(lines) {
+		t.Fatalf("Doc %d: unexpected line count %d, expected %d", k, doc.LineCount(), len(lines))
+	}
+	position := 0
+	for i, expected := range lines {
+		if line, err := doc.Line(i); err != nil || line != expected {
+			t.Fatalf("Doc %d: unexpected line %d: '%s' %v, expected '%s'", k, i, line, err, expected)
+		}
+		length := len(utf16.Encode([]rune(expected)))
+		if start, err := doc.Position(i, 0); err != nil || start != position {
+			t.Fatalf("Doc %d: unexpected start of line %d: %d %v, expected %d", k, i, start, err, position)
+		}
+		if line, column, err := doc.LineColumn(position + length); err != nil || line != i || column != length {
+			t.Fatalf("Doc %d: unexpected end of line %d: %d:%d %v, expected %d:%d", k, i, line, column, err, i, length)
+		}
+		position += length + 1
+	}
+}
@@ -1,18 +1,20 @@
-package main
+package fugue
 
 import (
 	"errors"
 	"fmt"
-	"strings"
 	"unicode/utf8"
 )
 
-type Client uint8
+type Client uint64
 type Seq int
 type Content string
 
+// maxSeq is the largest seq a client can reach
+const maxSeq Seq = 1<<32 - 1
+
 type Id struct {
-	client Client // up to 255 clients
+	client Client // randomly chosen by every replica
 	seq    Seq    // up to 2^32 - 1 operations per client
 }
 
@@ -21,27 +23,37 @@ type Item struct {
 	origin_left  *Id
 	origin_right *Id
 	deleted      bool
-	content      Content // Supports UTF-8 encoded content of any length
+	content      Content // Supports UTF-8 encoded content of any length, empty once collected, see gc.go
 	length       int     // length of the content
+	embed        []byte  // payload of an embed, whose content is a single embedContent, nil for text, see embed.go
 }
 
-type LinkedItem struct {
-	item Item
-	prev *LinkedItem
-	next *LinkedItem
+type linkedItem struct {
+	item   Item
+	prev   *linkedItem
+	next   *linkedItem
+	folded []*foldedItem // collected tombstones following the item, folded into its node by the GC, see gc.go
+
+	// Node of the treap indexing the list by position, see tree.go
+	parent   *linkedItem
+	left     *linkedItem
+	right    *linkedItem
+	priority uint32
+	counts   lengths // length of the content of the item in every unit
+	size     int     // sum of the lengths of the items in the subtree
+	visible  lengths // sum of the lengths of the visible items in the subtree, in every unit
 }
 
-type LinkedList struct {
+type linkedList struct {
 	length int // length of the list, not used
 	count  int // sum of the lengths of all items in the list
-	head   *LinkedItem
-	tail   *LinkedItem
+	head   *linkedItem
+	tail   *linkedItem
+	root   *linkedItem              // root of the treap
+	ids    map[Client][]*linkedItem // items of every client sorted by seq, see index.go
+	folded map[Client][]*foldedItem // folded tombstones of every client sorted by seq, see gc.go
 }
 
-var (
-	sb = &strings.Builder{}
-)
-
 // length returns the length of the content
 func (content *Content) length() int {
 	// The content is encoded in UTF-8, so we need to count the number of runes
@@ -49,8 +61,24 @@ func (content *Content) length() int {
 	return utf8.RuneCountInString(string(*content))
 }
 
+// splitAt splits the content in two at the given rune position
+//
+// The content of a collected item is empty whatever its length, so the loop stops at the end of the content
+func (content Content) splitAt(position int) (Content, Content) {
+	// Find the byte index corresponding to the rune position
+	byte_index := 0
+	for range position {
+		if byte_index == len(content) {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(string(content[byte_index:]))
+		byte_index += size
+	}
+	return content[:byte_index], content[byte_index:]
+}
+
 // delete removes the item from the list and updates both length and count
-func (list *LinkedList) delete(item *LinkedItem) error {
+func (list *linkedList) delete(item *linkedItem) error {
 	if item == nil {
 		return errors.New("item is nil")
 	}
@@ -65,15 +93,23 @@ func (list *LinkedList) delete(item *LinkedItem) error {
 		list.tail = item.prev
 	}
 	list.length--
-	list.count -= item.item.length
+	list.count -= item.length()
+	list.treeRemove(item)
+	list.indexRemove(item)
 	return nil
 }
 
+// markDeleted marks the item as deleted
+func (list *linkedList) markDeleted(at *linkedItem) {
+	at.item.deleted = true
+	list.fixUp(at)
+}
+
 // mergeLeft merges the content of the item at 'at' with the content of the item to its left
 // and deletes the item at 'at'.
 //
 // Warning: make sure to verify that the merging is valid before calling this function
-func (list *LinkedList) mergeLeft(at *LinkedItem) error {
+func (list *linkedList) mergeLeft(at *linkedItem) error {
 	if at == nil {
 		return errors.New("item is nil")
 	}
@@ -82,12 +118,9 @@ func (list *LinkedList) mergeLeft(at *LinkedItem) error {
 	}
 
 	at.prev.item.length += at.item.length
-	//at.prev.item.content += at.item.content
-	//Below should be better but no performance gain was observed
-	sb.WriteString(string(at.prev.item.content))
-	sb.WriteString(string(at.item.content))
-	at.prev.item.content = Content(sb.String())
-	sb.Reset()
+	at.prev.item.content += at.item.content
+	at.prev.counts = at.prev.counts.add(at.counts)
+	list.fixUp(at.prev)
 
 	// Update the count of the list, this change will be counterbalanced by the deletion
 	list.count += at.item.length
@@ -101,7 +134,7 @@ func (list *LinkedList) mergeLeft(at *LinkedItem) error {
 // and deletes the item at 'at'.
 //
 // Warning: make sure to verify that the merging is valid before calling this function
-func (list *LinkedList) mergeRight(at *LinkedItem) error {
+func (list *linkedList) mergeRight(at *linkedItem) error {
 	if at == nil {
 		return errors.New("item is nil")
 	}
@@ -116,7 +149,7 @@ func (list *LinkedList) mergeRight(at *LinkedItem) error {
 // - left: the left part of the split
 // - right: the right part of the split
 // - err: an error if the split is not possible
-func (list *LinkedList) splitTwo(at *LinkedItem, position int) (left *LinkedItem, right *LinkedItem, err error) {
+func (list *linkedList) splitTwo(at *linkedItem, position int) (left *linkedItem, right *linkedItem, err error) {
 	if at == nil {
 		return nil, nil, errors.New("item is nil")
 	}
@@ -130,27 +163,26 @@ func (list *LinkedList) splitTwo(at *LinkedItem, position int) (left *LinkedItem
 		return at, nil, nil
 	}
 
-	// Find the byte index corresponding to the rune position
-	content := string(at.item.content)
-	byte_index := 0
-	for range position {
-		_, size := utf8.DecodeRuneInString(content[byte_index:])
-		byte_index += size
-	}
+	left_content, right_content := at.item.content.splitAt(position)
 
 	// Create the left part of the split
 	left_item := at.item
-	left_item.content = Content(content[:byte_index])
+	left_item.content = left_content
 	left_item.length = position
 
 	// Modify the original item to be the right part of the split
 	at.item.id.seq = at.item.id.seq + Seq(position)
-	at.item.content = Content(content[byte_index:])
+	at.item.content = right_content
 	at.item.length = at.item.length - position
 	at.item.origin_left = &Id{
 		client: left_item.id.client,
 		seq:    at.item.id.seq - 1,
 	}
+	for _, f := range at.folded {
+		f.offset -= position
+	}
+	at.counts = at.counts.sub(left_content.lengths())
+	list.fixUp(at)
 
 	// Update the count of the list, this change will be counterbalanced by the insertion
 	list.count -= left_item.length
@@ -158,7 +190,7 @@ func (list *LinkedList) splitTwo(at *LinkedItem, position int) (left *LinkedItem
 	return at.prev, at, nil
 }
 
-func (list *LinkedList) insertAt(at *LinkedItem, position int, item Item) (left *LinkedItem, middle *LinkedItem, right *LinkedItem, err error) {
+func (list *linkedList) insertAt(at *linkedItem, position int, item Item) (left *linkedItem, middle *linkedItem, right *linkedItem, err error) {
 	left_split, right_split, err := list.splitTwo(at, position)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("error splitting item: %w", err)
@@ -173,10 +205,10 @@ func (list *LinkedList) insertAt(at *LinkedItem, position int, item Item) (left
 
 // insertAfter inserts an item after the given item in the list.
 // If 'at' is nil, the item is inserted at the beginning of the list.
-func (list *LinkedList) insertAfter(at *LinkedItem, item Item) {
+func (list *linkedList) insertAfter(at *linkedItem, item Item) {
 	list.length++
 	list.count += item.length
-	linked_item := &LinkedItem{item: item}
+	linked_item := &linkedItem{item: item, counts: item.content.lengths()}
 	if at == nil { // insert at the beginning
 		if list.head == nil { // insert in an empty list
 			list.head = linked_item
@@ -198,14 +230,16 @@ func (list *LinkedList) insertAfter(at *LinkedItem, item Item) {
 			at.next = linked_item
 		}
 	}
+	list.treeInsert(linked_item)
+	list.indexAdd(linked_item)
 }
 
 // insertBefore inserts an item before the given item in the list.
 // If 'at' is nil, the item is inserted at the end of the list.
-func (list *LinkedList) insertBefore(at *LinkedItem, item Item) {
+func (list *linkedList) insertBefore(at *linkedItem, item Item) {
 	list.length++
 	list.count += item.length
-	linked_item := &LinkedItem{item: item}
+	linked_item := &linkedItem{item: item, counts: item.content.lengths()}
 	if at == nil { // insert at the end
 		if list.tail == nil { // insert in an empty list
 			list.head = linked_item
@@ -227,4 +261,6 @@ func (list *LinkedList) insertBefore(at *LinkedItem, item Item) {
 			at.prev = linked_item
 		}
 	}
+	list.treeInsert(linked_item)
+	list.indexAdd(linked_item)
 }
@@ -0,0 +1,361 @@
+package fugue
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"unicode/utf8"
+)
+
+// The map of a document holds metadata next to the text, such as a title, tags or an owner.
+// Every change of a key is an entry taking the next seq of its client, like the characters of the text,
+// so the state vector and the updates of the document cover both the text and the map.
+// The entries of a key are ordered by a Lamport clock and the last one wins. The entries that lost
+// keep their id, so that the seqs of their client stay contiguous, but their value is dropped.
+
+// entry sets or removes the value of a key of the map
+type entry struct {
+	id          Id     // client and seq of the entry, taken from the clock of the items
+	clock       Seq    // Lamport clock ordering the entries of a key
+	key         string // key of the map
+	value       string // value of the key, empty if the entry removes the key or was overwritten
+	removed     bool   // whether the entry removes the key
+	overwritten bool   // whether a later entry of the key won, in which case its value was dropped
+}
+
+// Map is the last-writer-wins map of a document, with string keys and values
+//
+// A Map is a view on the document: its changes are part of the transactions, the events
+// and the updates of the document, but they are not undone by the UndoManager
+type Map struct {
+	doc *Doc
+	tx  *Tx // transaction the map is used in, nil to run every change in a transaction of its own
+}
+
+// Map returns the map of the document
+func (doc *Doc) Map() *Map {
+	return &Map{doc: doc}
+}
+
+// Map returns the map of the document, whose changes are made in the transaction
+func (tx *Tx) Map() *Map {
+	return &Map{doc: tx.doc, tx: tx}
+}
+
+// Get returns the value of the key
+//
+// returns false if the key is not in the map
+func (m *Map) Get(key string) (string, bool) {
+	var value string
+	var ok bool
+	m.read(func() {
+		value, ok = m.doc.getEntry(key)
+	})
+	return value, ok
+}
+
+// Set sets the value of the key
+//
+// The value set last wins over the values set before, including by other replicas.
+// returns an error if the key is empty
+func (m *Map) Set(key string, value string) error {
+	if key == "" {
+		return fmt.Errorf("the key must not be empty")
+	}
+	return m.change(func() error {
+		m.doc.localSetEntry(key, value, false)
+		return nil
+	})
+}
+
+// Delete removes the key from the map
+//
+// Removing a key that is not in the map does nothing
+func (m *Map) Delete(key string) error {
+	return m.change(func() error {
+		if _, ok := m.doc.getEntry(key); ok {
+			m.doc.localSetEntry(key, "", true)
+		}
+		return nil
+	})
+}
+
+// Keys returns the keys of the map, in increasing order
+func (m *Map) Keys() []string {
+	var keys []string
+	m.read(func() {
+		for key := range m.doc.keys {
+			if _, ok := m.doc.getEntry(key); ok {
+				keys = append(keys, key)
+			}
+		}
+	})
+	slices.Sort(keys)
+	return keys
+}
+
+// Len returns the number of keys of the map
+func (m *Map) Len() int {
+	return len(m.Keys())
+}
+
+// All returns a copy of the content of the map
+func (m *Map) All() map[string]string {
+	all := make(map[string]string)
+	m.read(func() {
+		for key := range m.doc.keys {
+			if value, ok := m.doc.getEntry(key); ok {
+				all[key] = value
+			}
+		}
+	})
+	return all
+}
+
+// read runs the function with the document locked for reading, unless the map is used in a transaction
+func (m *Map) read(fn func()) {
+	if m.tx == nil {
+		m.doc.mu.RLock()
+		defer m.doc.mu.RUnlock()
+	}
+	fn()
+}
+
+// change runs the function in the transaction of the map, or in a new local transaction
+func (m *Map) change(fn func() error) error {
+	if m.tx != nil {
+		return fn()
+	}
+	return m.doc.transact(true, fn)
+}
+
+// getEntry returns the value of the entry winning for the key
+//
+// returns false if the key has no entry or if the winning entry removes the key
+func (doc *Doc) getEntry(key string) (string, bool) {
+	id, ok := doc.keys[key]
+	if !ok || doc.entries[id].removed {
+		return "", false
+	}
+	return doc.entries[id].value, true
+}
+
+// localSetEntry creates an entry of the local client with the next seq of the client,
+// winning over every entry of the document
+func (doc *Doc) localSetEntry(key string, value string, removed bool) {
+	doc.integrateEntry(entry{
+		id:      Id{client: doc.client, seq: doc.nextSeq(doc.client)},
+		clock:   doc.nextEntryClock(),
+		key:     key,
+		value:   value,
+		removed: removed,
+	})
+}
+
+// nextEntryClock returns a Lamport clock greater than the clock of every entry of the document
+//
+// The entry with the greatest clock wins for its key, so only the winning entries are looked at
+func (doc *Doc) nextEntryClock() Seq {
+	clock := Seq(0)
+	for _, id := range doc.keys {
+		clock = max(clock, doc.entries[id].clock+1)
+	}
+	return clock
+}
+
+// compareEntries orders the entries of a key by Lamport clock, then by client
+func compareEntries(a entry, b entry) int {
+	return compareClocks(Id{client: a.id.client, seq: a.clock}, Id{client: b.id.client, seq: b.clock})
+}
+
+// integrateEntry adds the entry to the document and to the running transaction
+//
+// The entry must be the next seq of its client
+func (doc *Doc) integrateEntry(e entry) {
+	doc.version[e.id.client] = e.id.seq
+	e = doc.addEntry(e)
+	if doc.tx != nil {
+		doc.tx.entries = append(doc.tx.entries, e)
+	}
+}
+
+// addEntry adds the entry to the entries of the document, and drops the value
+// of the entry that loses against the other entries of its key
+//
+// Entries received already overwritten never win, their value is unknown.
+// returns the entry as added
+func (doc *Doc) addEntry(e entry) entry {
+	winner, ok := doc.keys[e.key]
+	switch {
+	case e.overwritten:
+	case ok && compareEntries(doc.entries[winner], e) > 0:
+		e.value, e.overwritten = "", true
+	default:
+		if ok {
+			lost := doc.entries[winner]
+			lost.value, lost.overwritten = "", true
+			doc.entries[winner] = lost
+		}
+		doc.keys[e.key] = e.id
+	}
+	doc.entries[e.id] = e
+	return e
+}
+
+// planEntries validates the entries of an update and merges them with the pending entries
+//
+// returns the entries that are not in the document, sorted by client and seq,
+// or an error if some entries are malformed or differ from the entries of the document
+func (doc *Doc) planEntries(entries []entry) ([]entry, error) {
+	planned := slices.Clone(doc.pending_entries)
+	for _, e := range entries {
+		if !validEntry(e) {
+			return nil, fmt.Errorf("%w: entry %d:%d", ErrMalformedItem, e.id.client, e.id.seq)
+		}
+		if !isInVersion(&e.id, &doc.version) {
+			planned = append(planned, e)
+			continue
+		}
+		ours, ok := doc.entries[e.id]
+		if !ok || !sameEntry(ours, e) {
+			return nil, fmt.Errorf("%w: client %d differs at seq %d", ErrClientConflict, e.id.client, e.id.seq)
+		}
+	}
+	slices.SortFunc(planned, compareEntryIds)
+	planned = slices.CompactFunc(planned, func(a, b entry) bool { return a.id == b.id })
+	return planned, nil
+}
+
+// integrateEntries integrates the pending entries that follow the last seq of their client
+//
+// returns true if some entries were integrated, which may allow pending items to be integrated
+func (doc *Doc) integrateEntries() bool {
+	progressed := false
+	pending := doc.pending_entries[:0]
+	for _, e := range doc.pending_entries {
+		switch {
+		case isInVersion(&e.id, &doc.version):
+			// The change was integrated before the items following it, or the seq was taken
+			// by another change as the client has forked
+		case e.id.seq == doc.nextSeq(e.id.client):
+			doc.integrateEntry(e)
+			progressed = true
+		default:
+			pending = append(pending, e)
+		}
+	}
+	doc.pending_entries = pending
+	return progressed
+}
+
+// checkOrigins checks that the origins of the item are not entries, marks or deletions of the document or of the update,
+// which have no place in the text, nor items of the other roots of a container
+//
+// Every id of the version that is not an item of the document is an entry, a mark, a deletion or an item of another root.
+// returns ErrMalformedItem if an origin is an entry, a mark, a deletion or an item of another root
+func (doc *Doc) checkOrigins(item Item, change_ids deleteSet) error {
+	for _, origin := range []*Id{item.origin_left, item.origin_right} {
+		if origin == nil {
+			continue
+		}
+		if _, found := doc.content.itemOf(*origin); isInVersion(origin, &doc.version) && !found || change_ids.contains(*origin) {
+			return fmt.Errorf("%w: item %d:%d has %d:%d as origin, which is not an item of the document", ErrMalformedItem, item.id.client, item.id.seq, origin.client, origin.seq)
+		}
+	}
+	return nil
+}
+
+// sameEntry checks that two entries with the same id are the same change,
+// ignoring the values dropped when they were overwritten
+func sameEntry(a entry, b entry) bool {
+	return a.clock == b.clock && a.key == b.key && a.removed == b.removed &&
+		(a.overwritten || b.overwritten || a.value == b.value)
+}
+
+// validEntry checks that the key and the value of the entry are valid UTF-8, that the key is not empty,
+// and that the entries without a value have none
+func validEntry(e entry) bool {
+	return e.key != "" && utf8.ValidString(e.key) && utf8.ValidString(e.value) &&
+		e.id.seq >= 0 && e.id.seq <= maxSeq && e.clock >= 0 && e.clock <= maxSeq &&
+		(e.value == "" || !e.removed && !e.overwritten)
+}
+
+// sortedEntries returns the entries of the document, sorted by client and seq
+func (doc *Doc) sortedEntries() []entry {
+	entries := slices.Collect(maps.Values(doc.entries))
+	slices.SortFunc(entries, compareEntryIds)
+	return entries
+}
+
+// compareEntryIds orders the entries by client, then by seq
+func compareEntryIds(a entry, b entry) int {
+	return cmp.Or(cmp.Compare(a.id.client, b.id.client), cmp.Compare(a.id.seq, b.id.seq))
+}
+
+// changedKeys returns the keys whose value was changed by the entries, in increasing order
+func changedKeys(entries []entry) []string {
+	var keys []string
+	for _, e := range entries {
+		if !e.overwritten {
+			keys = append(keys, e.key)
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// Flags of the byte describing how an entry is encoded
+const (
+	flagRemoved     byte = 1 << 0 // the entry removes its key, it has no value
+	flagOverwritten byte = 1 << 1 // the entry was overwritten, its value is not written
+)
+
+func (enc *encoder) writeEntries(entries []entry) {
+	enc.writeUvarint(uint64(len(entries)))
+	for _, e := range entries {
+		var info byte
+		if e.removed {
+			info |= flagRemoved
+		}
+		if e.overwritten {
+			info |= flagOverwritten
+		}
+		enc.writeByte(info)
+		enc.writeClient(e.id.client)
+		enc.writeUvarint(uint64(e.id.seq))
+		enc.writeUvarint(uint64(e.clock))
+		enc.writeString(e.key)
+		if info == 0 {
+			enc.writeString(e.value)
+		}
+	}
+}
+
+func (dec *decoder) readEntries() []entry {
+	count := dec.readLength()
+	entries := make([]entry, 0, count)
+	for range count {
+		info := dec.readByte()
+		if info&^(flagRemoved|flagOverwritten) != 0 {
+			dec.fail("unknown entry flags %x", info)
+		}
+		e := entry{removed: info&flagRemoved != 0, overwritten: info&flagOverwritten != 0}
+		e.id.client = dec.readClient()
+		e.id.seq = dec.readSeq()
+		e.clock = dec.readSeq()
+		e.key = dec.readString()
+		if info == 0 {
+			e.value = dec.readString()
+		}
+		if dec.err != nil {
+			return nil
+		}
+		if !validEntry(e) {
+			dec.fail("invalid entry %d:%d", e.id.client, e.id.seq)
+			return nil
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,181 @@
+package fugue
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+// checkMaps checks that the documents have the same text and the same map
+func checkMaps(t *testing.T, docs ...*Doc) {
+	t.Helper()
+	for _, doc := range docs[1:] {
+		if doc.Text() != docs[0].Text() || !maps.Equal(doc.Map().All(), docs[0].Map().All()) {
+			t.Fatalf("Documents diverged: '%s' %v and '%s' %v", docs[0].Text(), docs[0].Map().All(), doc.Text(), doc.Map().All())
+		}
+	}
+}
+
+func TestMap(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello")
+	doc1.Map().Set("title", "Greeting")
+	doc1.Map().Set("owner", "ada")
+	doc1.Insert(5, " world")
+	syncDocs(t, doc1, doc2)
+	checkMaps(t, doc1, doc2)
+	if value, ok := doc2.Map().Get("title"); !ok || value != "Greeting" {
+		t.Errorf("Unexpected value '%s' %v", value, ok)
+	}
+	// The text and the map share the clock of the document
+	if version := doc1.Version(); version[1] != 12 {
+		t.Errorf("Unexpected version %v", version)
+	}
+	// A value set after seeing another one wins, whatever the clients
+	doc2.Map().Set("title", "Hello")
+	syncDocs(t, doc2, doc1)
+	// Concurrent values are ordered by client
+	doc1.Map().Set("owner", "bob")
+	doc2.Map().Set("owner", "eve")
+	doc1.Map().Delete("title")
+	syncDocs(t, doc1, doc2)
+	syncDocs(t, doc2, doc1)
+	checkMaps(t, doc1, doc2)
+	if value, _ := doc1.Map().Get("owner"); value != "eve" {
+		t.Errorf("Unexpected owner '%s'", value)
+	}
+	if _, ok := doc1.Map().Get("title"); ok || doc1.Map().Len() != 1 || !slices.Equal(doc1.Map().Keys(), []string{"owner"}) {
+		t.Errorf("Unexpected map %v", doc1.Map().All())
+	}
+	if err := doc1.Map().Set("", "value"); err == nil {
+		t.Errorf("Expected an error for an empty key")
+	}
+	// The whole state is loaded back, in binary and in JSON
+	loaded := NewDocWithClient(3)
+	if err := loaded.ApplyUpdate(doc1.EncodeState()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := json.Marshal(doc1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	from_json := NewDocWithClient(4)
+	if err := json.Unmarshal(data, from_json); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkMaps(t, doc1, loaded, from_json)
+	// Later changes still win over the loaded ones
+	from_json.Map().Set("owner", "joe")
+	syncDocs(t, from_json, doc1)
+	if value, _ := doc1.Map().Get("owner"); value != "joe" {
+		t.Errorf("Unexpected owner '%s'", value)
+	}
+}
+
+func TestMapUpdates(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	var updates [][]byte
+	doc1.ObserveUpdates(func(update []byte, local bool) {
+		updates = append(updates, update)
+	})
+	var events []Event
+	doc2.Observe(func(event Event) {
+		events = append(events, event)
+	})
+	doc1.Insert(0, "abc")
+	doc1.Transact(func(tx *Tx) error {
+		tx.Map().Set("b", "1")
+		tx.Map().Set("a", "2")
+		tx.Map().Set("b", "3")
+		return tx.Insert(3, "d")
+	})
+	doc1.Insert(4, "e")
+	// The updates wait for the ones they depend on, whether they carry text or entries
+	for _, i := range []int{2, 1, 0} {
+		if err := doc2.ApplyUpdate(updates[i]); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkMaps(t, doc1, doc2)
+	if doc2.Text() != "abcde" || len(doc2.Missing()) != 0 {
+		t.Errorf("Unexpected content '%s', missing %v", doc2.Text(), doc2.Missing())
+	}
+	if len(events) != 1 || !slices.Equal(events[0].Keys, []string{"a", "b"}) {
+		t.Errorf("Unexpected events %v", events)
+	}
+	// A client reused by another replica with different entries is detected
+	forked := NewDocWithClient(1)
+	forked.Insert(0, "abc")
+	forked.Map().Set("c", "forked")
+	if err := doc2.ApplyUpdate(forked.EncodeState()); !errors.Is(err, ErrClientConflict) {
+		t.Errorf("Unexpected error for a forked client: %v", err)
+	}
+	// Items cannot be inserted after an entry
+	upd := encodeUpdate(&update{
+		items:   []Item{{id: Id{client: 5, seq: 1}, origin_left: &Id{client: 5, seq: 0}, content: "x", length: 1}},
+		deleted: make(deleteSet),
+		entries: []entry{{id: Id{client: 5, seq: 0}, key: "k", value: "v"}},
+	})
+	if err := NewDocWithClient(6).ApplyUpdate(upd); !errors.Is(err, ErrMalformedItem) {
+		t.Errorf("Unexpected error for an item after an entry: %v", err)
+	}
+}
+
+func TestMapUndo(t *testing.T) {
+	doc := NewDocWithClient(1)
+	um, now := newTestUndoManager(doc)
+	doc.Insert(0, "abc")
+	*now = now.Add(time.Second)
+	doc.Map().Set("title", "t")
+	*now = now.Add(time.Second)
+	// Entries of the map are not undone, and do not hide the text changes from the undo manager
+	if err := um.Undo(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if value, _ := doc.Map().Get("title"); doc.Text() != "" || value != "t" {
+		t.Errorf("Unexpected content '%s' and title '%s'", doc.Text(), value)
+	}
+	if um.CanUndo() {
+		t.Errorf("Unexpected changes to undo")
+	}
+}
+
+func TestMapFuzzer(t *testing.T) {
+	const trials int64 = 50
+	keys := []string{"title", "tags", "owner"}
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		for range 200 {
+			j := rng.Intn(len(docs))
+			switch r := rng.Float32(); {
+			case r < 0.3:
+				docs[j].Map().Set(keys[rng.Intn(len(keys))], string(rune('a'+rng.Intn(26))))
+			case r < 0.4:
+				docs[j].Map().Delete(keys[rng.Intn(len(keys))])
+			default:
+				randomEdit(t, rng, docs[j])
+			}
+			if rng.Float32() < 0.3 {
+				k := rng.Intn(len(docs))
+				syncDocs(t, docs[j], docs[k])
+				syncDocs(t, docs[k], docs[j])
+				checkMaps(t, docs[j], docs[k])
+			}
+		}
+		for _, doc := range docs[1:] {
+			syncDocs(t, docs[0], doc)
+			syncDocs(t, doc, docs[0])
+		}
+		for _, doc := range docs[1:] {
+			syncDocs(t, docs[0], doc)
+		}
+		checkMaps(t, docs...)
+	}
+}
@@ -0,0 +1,310 @@
+package fugue
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"unicode/utf8"
+)
+
+// Marks format ranges of the text, as in Peritext: the ends of a mark are anchored to characters,
+// on the side given by its expansion, so that the mark keeps covering the same characters under concurrent edits.
+// When several marks set the same attribute on a character, the last one wins.
+// Every mark takes the next seq of its client, like the entries of the map, so the state vector covers the marks
+// and a diff only holds the marks the peer is missing. The marks are ordered by a Lamport clock.
+
+// Expand tells whether text inserted at the ends of a formatted range is formatted too
+type Expand int8
+
+const (
+	ExpandNone   Expand = 0                          // text inserted at the ends is not formatted, as for links
+	ExpandAfter  Expand = 1 << 0                     // text inserted at the end is formatted, as for bold or italic
+	ExpandBefore Expand = 1 << 1                     // text inserted at the start is formatted
+	ExpandBoth   Expand = ExpandAfter | ExpandBefore // text inserted at both ends is formatted
+)
+
+// mark sets an attribute on a range of the text
+type mark struct {
+	id    Id               // client and seq of the mark, taken from the clock of the items
+	clock Seq              // Lamport clock ordering the marks
+	name  string           // name of the attribute
+	value string           // value of the attribute, empty to remove the attribute
+	start RelativePosition // first formatted position
+	end   RelativePosition // position right after the last formatted character
+}
+
+// FormattedRun is a run of visible text with the same attributes, or a single embed
+type FormattedRun struct {
+	Text       string            `json:"insert"`
+	Embed      []byte            `json:"embed,omitempty"` // payload of the embed, whose text is U+FFFC
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Format sets the attribute on the given range, counted in the unit of the document
+//
+// An empty value removes the attribute from the range. The value set last wins over the values
+// set before on the same characters, including by other replicas.
+// returns an error if the range is out of bounds, starts or ends inside a character, or if the name is empty
+func (doc *Doc) Format(position int, length int, name string, value string, expand Expand) error {
+	return doc.Transact(func(tx *Tx) error {
+		return tx.Format(position, length, name, value, expand)
+	})
+}
+
+// Format sets the attribute on the given range, counted in the unit of the document
+//
+// An empty value removes the attribute from the range.
+// returns an error if the range is out of bounds, starts or ends inside a character, or if the name is empty
+func (tx *Tx) Format(position int, length int, name string, value string, expand Expand) error {
+	if length <= 0 {
+		return fmt.Errorf("length must be greater than 0")
+	}
+	if name == "" {
+		return fmt.Errorf("the name of the attribute must not be empty")
+	}
+	start, err := tx.doc.toRunes(position)
+	if err != nil {
+		return err
+	}
+	end, err := tx.doc.toRunes(position + length)
+	if err != nil {
+		return err
+	}
+	doc := tx.doc
+	m := mark{
+		id:    Id{client: doc.client, seq: doc.nextSeq(doc.client)},
+		clock: doc.nextMarkClock(),
+		name:  name,
+		value: value,
+		start: doc.relativePosition(start, AssocRight),
+		end:   doc.relativePosition(end, AssocLeft),
+	}
+	if expand&ExpandBefore != 0 {
+		// Text inserted at the start lands after the character before the range
+		m.start = doc.relativePosition(start, AssocLeft)
+	}
+	if expand&ExpandAfter != 0 {
+		// Text inserted at the end lands before the character after the range
+		m.end = doc.relativePosition(end, AssocRight)
+	}
+	doc.integrateMark(m)
+	return nil
+}
+
+// FormattedRuns returns the visible text of the document split in runs of text with the same attributes,
+// every embed being a run of its own
+func (doc *Doc) FormattedRuns() []FormattedRun {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.formattedRuns()
+}
+
+// FormattedRuns returns the visible text of the document split in runs of text with the same attributes,
+// including the changes of the transaction
+func (tx *Tx) FormattedRuns() []FormattedRun {
+	return tx.doc.formattedRuns()
+}
+
+// formattedRuns splits the visible text at the ends of the marks and around the embeds,
+// and applies the marks covering every run in the order of their ids
+func (doc *Doc) formattedRuns() []FormattedRun {
+	type resolved struct {
+		mark       mark
+		start, end int
+	}
+	var marks []resolved
+	cuts := []int{0, doc.content.visibleLength(UnitRune)}
+	for _, m := range doc.sortedMarks() {
+		start, start_err := doc.absolutePosition(m.start)
+		end, end_err := doc.absolutePosition(m.end)
+		if start_err != nil || end_err != nil || start >= end {
+			// The mark covers no visible character, or its anchors have not been received yet
+			continue
+		}
+		marks = append(marks, resolved{mark: m, start: start, end: end})
+		cuts = append(cuts, start, end)
+	}
+	embeds := make(map[int][]byte)
+	position := 0
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		if linked_item.item.deleted {
+			continue
+		}
+		if linked_item.item.embed != nil {
+			embeds[position] = linked_item.item.embed
+			cuts = append(cuts, position, position+1)
+		}
+		position += linked_item.item.length
+	}
+	slices.Sort(cuts)
+	cuts = slices.Compact(cuts)
+	text := []rune(string(doc.getContent()))
+	var runs []FormattedRun
+	for i := 1; i < len(cuts); i++ {
+		attributes := make(map[string]string)
+		for _, r := range marks {
+			if r.start <= cuts[i-1] && cuts[i] <= r.end {
+				if r.mark.value == "" {
+					delete(attributes, r.mark.name)
+				} else {
+					attributes[r.mark.name] = r.mark.value
+				}
+			}
+		}
+		if len(attributes) == 0 {
+			attributes = nil
+		}
+		run := FormattedRun{Text: string(text[cuts[i-1]:cuts[i]]), Embed: embeds[cuts[i-1]], Attributes: attributes}
+		if last := len(runs) - 1; last >= 0 && run.Embed == nil && runs[last].Embed == nil && maps.Equal(runs[last].Attributes, attributes) {
+			runs[last].Text += run.Text
+		} else {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// sortedMarks returns the marks of the document from the oldest to the newest
+func (doc *Doc) sortedMarks() []mark {
+	marks := slices.Collect(maps.Values(doc.marks))
+	slices.SortFunc(marks, compareMarks)
+	return marks
+}
+
+// compareMarks orders the marks by Lamport clock, then by client, then by seq
+func compareMarks(a mark, b mark) int {
+	return cmp.Or(compareClocks(Id{client: a.id.client, seq: a.clock}, Id{client: b.id.client, seq: b.clock}), cmp.Compare(a.id.seq, b.id.seq))
+}
+
+// compareMarkIds orders the marks by client, then by seq
+func compareMarkIds(a mark, b mark) int {
+	return cmp.Or(cmp.Compare(a.id.client, b.id.client), cmp.Compare(a.id.seq, b.id.seq))
+}
+
+// compareClocks orders changes by Lamport clock, then by client, the clock of a change being the seq of the id
+func compareClocks(a Id, b Id) int {
+	if a.seq != b.seq {
+		return int(a.seq - b.seq)
+	}
+	if a.client < b.client {
+		return -1
+	}
+	if a.client > b.client {
+		return 1
+	}
+	return 0
+}
+
+// nextMarkClock returns a Lamport clock greater than the clock of every mark of the document,
+// so that a new mark wins over the marks seen before
+func (doc *Doc) nextMarkClock() Seq {
+	clock := Seq(0)
+	for _, m := range doc.marks {
+		clock = max(clock, m.clock+1)
+	}
+	return clock
+}
+
+// integrateMark adds the mark to the document and to the running transaction
+//
+// The mark must be the next seq of its client
+func (doc *Doc) integrateMark(m mark) {
+	doc.version[m.id.client] = m.id.seq
+	doc.marks[m.id] = m
+	if doc.tx != nil {
+		doc.tx.marks = append(doc.tx.marks, m)
+	}
+}
+
+// planMarks validates the marks of an update and merges them with the pending marks
+//
+// returns the marks that are not in the document, sorted by client and seq,
+// or an error if some marks differ from the marks of the document
+func (doc *Doc) planMarks(marks []mark) ([]mark, error) {
+	planned := slices.Clone(doc.pending_marks)
+	for _, m := range marks {
+		if !isInVersion(&m.id, &doc.version) {
+			planned = append(planned, m)
+			continue
+		}
+		ours, ok := doc.marks[m.id]
+		if !ok || !sameMark(ours, m) {
+			return nil, fmt.Errorf("%w: client %d differs at seq %d", ErrClientConflict, m.id.client, m.id.seq)
+		}
+	}
+	slices.SortFunc(planned, compareMarkIds)
+	planned = slices.CompactFunc(planned, func(a, b mark) bool { return a.id == b.id })
+	return planned, nil
+}
+
+// integrateMarks integrates the pending marks that follow the last seq of their client
+//
+// returns true if some marks were integrated, which may allow pending items and entries to be integrated
+func (doc *Doc) integrateMarks() bool {
+	progressed := false
+	pending := doc.pending_marks[:0]
+	for _, m := range doc.pending_marks {
+		switch {
+		case isInVersion(&m.id, &doc.version):
+			// The change was integrated before the items following it, or the seq was taken
+			// by another change as the client has forked
+		case m.id.seq == doc.nextSeq(m.id.client):
+			doc.integrateMark(m)
+			progressed = true
+		default:
+			pending = append(pending, m)
+		}
+	}
+	doc.pending_marks = pending
+	return progressed
+}
+
+// sameMark checks that two marks with the same id are the same change
+func sameMark(a mark, b mark) bool {
+	return a.clock == b.clock && a.name == b.name && a.value == b.value &&
+		a.start.id.equals(b.start.id) && a.start.assoc == b.start.assoc && a.end.id.equals(b.end.id) && a.end.assoc == b.end.assoc
+}
+
+// validMark checks that the name and the value of the mark are valid UTF-8, and that the name is not empty
+func validMark(m mark) bool {
+	return m.name != "" && utf8.ValidString(m.name) && utf8.ValidString(m.value)
+}
+
+// writeMarks writes the marks with their seq and clock
+func (enc *encoder) writeMarks(marks []mark) {
+	enc.writeUvarint(uint64(len(marks)))
+	for _, m := range marks {
+		enc.writeClient(m.id.client)
+		enc.writeUvarint(uint64(m.id.seq))
+		enc.writeUvarint(uint64(m.clock))
+		enc.writeString(m.name)
+		enc.writeString(m.value)
+		enc.writeRelativePosition(m.start)
+		enc.writeRelativePosition(m.end)
+	}
+}
+
+func (dec *decoder) readMarks() []mark {
+	count := dec.readLength()
+	marks := make([]mark, 0, count)
+	for range count {
+		var m mark
+		m.id.client = dec.readClient()
+		m.id.seq = dec.readSeq()
+		m.clock = dec.readSeq()
+		m.name = dec.readString()
+		m.value = dec.readString()
+		m.start = dec.readRelativePosition()
+		m.end = dec.readRelativePosition()
+		if dec.err != nil {
+			return nil
+		}
+		if !validMark(m) {
+			dec.fail("invalid mark %d:%d", m.id.client, m.id.seq)
+			return nil
+		}
+		marks = append(marks, m)
+	}
+	return marks
+}
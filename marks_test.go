@@ -0,0 +1,170 @@
+package fugue
+
+import (
+	"encoding/json"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// equalRuns checks if the formatted runs are equal
+func equalRuns(a []FormattedRun, b []FormattedRun) bool {
+	return slices.EqualFunc(a, b, func(x, y FormattedRun) bool {
+		return x.Text == y.Text && maps.Equal(x.Attributes, y.Attributes)
+	})
+}
+
+func TestMarks(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello world")
+	syncDocs(t, doc1, doc2)
+	var events []Event
+	doc1.Observe(func(event Event) { events = append(events, event) })
+	// Bold expands at its end, links do not
+	if err := doc1.Format(0, 5, "bold", "true", ExpandAfter); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := doc1.Format(6, 5, "link", "https://example.com", ExpandNone); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(events) != 2 || !events[0].Formatted || len(events[0].Delta) != 0 {
+		t.Errorf("Unexpected events: %v", events)
+	}
+	// Concurrent inserts at the ends of the marks
+	doc2.Insert(11, "!")
+	doc2.Insert(5, ",")
+	doc2.Insert(6, " dear")
+	syncDocs(t, doc1, doc2)
+	syncDocs(t, doc2, doc1)
+	// Text typed at the end of the bold range is bold too
+	expected := []FormattedRun{
+		{Text: "Hello, dear", Attributes: map[string]string{"bold": "true"}},
+		{Text: " "},
+		{Text: "world", Attributes: map[string]string{"link": "https://example.com"}},
+		{Text: "!"},
+	}
+	for _, doc := range []*Doc{doc1, doc2} {
+		if runs := doc.FormattedRuns(); !equalRuns(runs, expected) {
+			t.Errorf("Unexpected runs: %v, expected %v", runs, expected)
+		}
+	}
+	// The last value wins, and an empty value removes the attribute
+	doc1.Format(0, 3, "color", "red", ExpandNone)
+	doc2.Format(2, 3, "color", "blue", ExpandNone)
+	syncDocs(t, doc1, doc2)
+	doc2.Format(0, 6, "bold", "", ExpandNone)
+	syncDocs(t, doc2, doc1)
+	expected = []FormattedRun{
+		{Text: "He", Attributes: map[string]string{"color": "red"}},
+		{Text: "llo", Attributes: map[string]string{"color": "blue"}},
+		{Text: ","},
+		{Text: " dear", Attributes: map[string]string{"bold": "true"}},
+		{Text: " "},
+		{Text: "world", Attributes: map[string]string{"link": "https://example.com"}},
+		{Text: "!"},
+	}
+	for _, doc := range []*Doc{doc1, doc2} {
+		if runs := doc.FormattedRuns(); !equalRuns(runs, expected) {
+			t.Errorf("Unexpected runs: %v, expected %v", runs, expected)
+		}
+	}
+	// Marks are persisted with the document
+	doc3 := NewDocWithClient(3)
+	doc3.ApplyUpdate(doc1.EncodeState())
+	data, err := json.Marshal(doc1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	doc4 := NewDocWithClient(4)
+	if err := json.Unmarshal(data, doc4); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, doc := range []*Doc{doc3, doc4} {
+		if runs := doc.FormattedRuns(); !equalRuns(runs, expected) {
+			t.Errorf("Unexpected runs: %v, expected %v", runs, expected)
+		}
+	}
+}
+
+func TestMarksVersioned(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "abc")
+	for range 100 {
+		doc1.Format(0, 3, "bold", "true", ExpandNone)
+	}
+	syncDocs(t, doc1, doc2)
+	// Marks take the seqs of their client, so a peer having them is not sent them again
+	if version := doc2.Version(); version[1] != 102 {
+		t.Errorf("Unexpected version %v", version)
+	}
+	diff, err := doc1.EncodeDiff(doc2.EncodeStateVector())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if upd, _ := decodeUpdate(diff); len(upd.marks) != 0 {
+		t.Errorf("Unexpected marks in the diff: %d", len(upd.marks))
+	}
+	// A mark waits for the previous seq of its client
+	vector := doc1.EncodeStateVector()
+	doc1.Insert(3, "d")
+	insert, _ := doc1.EncodeDiff(vector)
+	vector = doc1.EncodeStateVector()
+	doc1.Format(0, 4, "italic", "true", ExpandNone)
+	format, _ := doc1.EncodeDiff(vector)
+	if err := doc2.ApplyUpdate(format); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if missing := doc2.Missing(); !maps.Equal(missing, Version{1: 103}) {
+		t.Errorf("Unexpected missing seqs %v", missing)
+	}
+	if err := doc2.ApplyUpdate(insert); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if runs := doc2.FormattedRuns(); !equalRuns(runs, doc1.FormattedRuns()) || !maps.Equal(doc2.Version(), doc1.Version()) {
+		t.Errorf("Unexpected runs %v", runs)
+	}
+}
+
+func TestMarksFuzzer(t *testing.T) {
+	const trials int64 = 50
+	names := []string{"bold", "italic", "link"}
+	values := []string{"", "a", "b"}
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		for range 200 {
+			j := rng.Intn(len(docs))
+			doc := docs[j]
+			if length := doc.Len(); length == 0 || rng.Float32() < 0.7 {
+				randomEdit(t, rng, doc)
+			} else {
+				position := rng.Intn(length)
+				doc.Format(position, 1+rng.Intn(length-position), names[rng.Intn(len(names))], values[rng.Intn(len(values))], Expand(rng.Intn(4)))
+			}
+			if rng.Float32() < 0.2 {
+				syncDocs(t, doc, docs[rng.Intn(len(docs))])
+			}
+		}
+		for j := range docs {
+			for k := range docs {
+				syncDocs(t, docs[j], docs[k])
+			}
+		}
+		runs := docs[0].FormattedRuns()
+		text := ""
+		for _, run := range runs {
+			text += run.Text
+		}
+		if text != docs[0].Text() {
+			t.Fatalf("Trial %d: runs %v do not match the text '%s'", i, runs, docs[0].Text())
+		}
+		for k, doc := range docs {
+			if other := doc.FormattedRuns(); !equalRuns(other, runs) {
+				t.Fatalf("Trial %d: doc %d has runs %v, expected %v", i, k, other, runs)
+			}
+		}
+	}
+}
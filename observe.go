@@ -0,0 +1,243 @@
+package fugue
+
+import (
+	"slices"
+	"sync"
+)
+
+// DeltaOp is one operation of a delta, only one of its fields is set
+//
+// A delta is applied from the start of the document: Retain skips visible characters,
+// Insert inserts text at the current position, Embed inserts an embed with the payload,
+// in base64 in JSON as in FormattedRun, and Delete deletes visible characters
+type DeltaOp struct {
+	Retain int    `json:"retain,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Embed  []byte `json:"embed,omitempty"`
+	Delete int    `json:"delete,omitempty"`
+}
+
+// Event describes a change of the document
+type Event struct {
+	Delta     []DeltaOp // the change, in positions of the visible characters before the change, in the unit of the document
+	Local     bool      // whether the change has been made locally rather than received from a remote update
+	Formatted bool      // whether marks have been added, changing the formatting of the text
+	Keys      []string  // keys of the map whose value changed, in increasing order
+}
+
+// observer is a function notified of the changes of the document
+type observer struct {
+	fn        func(Event)                     // called with the event of every change
+	update_fn func(update []byte, local bool) // called with the update of every change
+	tx_fn     func(*transaction)              // called with the transaction of every change while the document is locked, used internally
+}
+
+// dispatcher runs the notifications of the observers in the order of the transactions
+//
+// Notifications are queued while the document is locked, and run once it is unlocked,
+// so that observers can read the document without blocking the next transactions
+type dispatcher struct {
+	running sync.Mutex // held while notifying the observers, so that they see the changes in order
+	mu      sync.Mutex // guards the queue
+	queue   []func()
+}
+
+// push queues the notifications, the document must be locked so that they keep the order of the transactions
+func (d *dispatcher) push(notifications ...func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queue = append(d.queue, notifications...)
+}
+
+// run runs the queued notifications, including the ones queued by the caller, once the document is unlocked
+//
+// The notifications queued by other goroutines meanwhile are run too, so run returns
+// once the notifications of the caller have been run, by it or by another goroutine
+func (d *dispatcher) run() {
+	d.running.Lock()
+	defer d.running.Unlock()
+	for {
+		d.mu.Lock()
+		if len(d.queue) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		notify := d.queue[0]
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+		notify()
+	}
+}
+
+// Observe registers a function called after every change of the document,
+// whether it comes from a local edit or from a remote update
+//
+// The function is called once the document is unlocked, so it can read the document but must not modify it.
+// returns a function that unregisters the observer
+func (doc *Doc) Observe(fn func(Event)) (unobserve func()) {
+	return doc.observe(&observer{fn: fn})
+}
+
+// ObserveUpdates registers a function called after every change of the document
+// with the update to send to the other replicas, as applied by ApplyUpdate
+//
+// local tells whether the change has been made locally, remote changes usually don't need to be sent back.
+// returns a function that unregisters the observer
+func (doc *Doc) ObserveUpdates(fn func(update []byte, local bool)) (unobserve func()) {
+	return doc.observe(&observer{update_fn: fn})
+}
+
+// observe registers the observer
+//
+// returns a function that unregisters the observer
+func (doc *Doc) observe(obs *observer) func() {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	doc.observers = append(doc.observers, obs)
+	return func() {
+		doc.mu.Lock()
+		defer doc.mu.Unlock()
+		doc.observers = slices.DeleteFunc(doc.observers, func(other *observer) bool { return other == obs })
+	}
+}
+
+// notify sends the transaction to the internal observers,
+// and prepares the event and the update for the other observers
+//
+// The event and the update are only computed if an observer needs them.
+// returns a function sending them, to call once the document is unlocked
+func (doc *Doc) notify(tx *transaction) func() {
+	// Observers can unregister themselves while being notified
+	observers := slices.Clone(doc.observers)
+	var event *Event
+	var update []byte
+	for _, obs := range observers {
+		if obs.tx_fn != nil {
+			obs.tx_fn(tx)
+		}
+		if obs.fn != nil && event == nil {
+			event = &Event{
+				Delta:     doc.delta(tx),
+				Local:     tx.local,
+				Formatted: len(tx.marks) > 0,
+				Keys:      changedKeys(tx.entries),
+			}
+		}
+		if obs.update_fn != nil && update == nil {
+			update = encodeUpdate(tx.update(doc))
+		}
+	}
+	return func() {
+		for _, obs := range observers {
+			if obs.fn != nil {
+				obs.fn(*event)
+			}
+			if obs.update_fn != nil {
+				obs.update_fn(update, tx.local)
+			}
+		}
+	}
+}
+
+// delta computes the changes made by the transaction, in positions of the visible characters
+// counted in the unit of the document
+//
+// Characters that are not in the version from before the transaction have been inserted,
+// and characters in the delete set of the transaction have been deleted. Only the items holding
+// these characters are visited, in document order, and the unchanged characters between them are retained.
+func (doc *Doc) delta(tx *transaction) []DeltaOp {
+	var delta []DeltaOp
+	// Visible characters of the document up to the end of the last visited item, after the transaction
+	visited := 0
+	for _, linked_item := range doc.changedItems(tx) {
+		item := linked_item.item
+		if item.deleted && len(tx.deleted.intersect(item.id.client, item.id.seq, item.length)) == 0 {
+			// The item has been inserted already deleted
+			continue
+		}
+		before := doc.content.visibleBefore(linked_item)[doc.unit]
+		if before > visited {
+			delta = appendDeltaOp(delta, DeltaOp{Retain: before - visited})
+		}
+		visited = before + linked_item.visibleLength()[doc.unit]
+		for _, segment := range tx.segments(item) {
+			inserted := !isInVersion(&Id{client: item.id.client, seq: segment.start}, &tx.before)
+			// Lengths are counted in the unit of the document, using the cached counts of whole items
+			length := linked_item.counts[doc.unit]
+			if segment.length != item.length {
+				length = doc.unitLength(contentRange(item, segment.start, segment.length))
+			}
+			switch {
+			case inserted && !item.deleted && item.embed != nil:
+				delta = appendDeltaOp(delta, DeltaOp{Embed: item.embed})
+			case inserted && !item.deleted:
+				delta = appendDeltaOp(delta, DeltaOp{Insert: string(contentRange(item, segment.start, segment.length))})
+			case !inserted && tx.deleted.contains(Id{client: item.id.client, seq: segment.start}):
+				delta = appendDeltaOp(delta, DeltaOp{Delete: length})
+			case !inserted && !item.deleted:
+				delta = appendDeltaOp(delta, DeltaOp{Retain: length})
+			}
+		}
+	}
+	// A trailing retain carries no information
+	if len(delta) > 0 && delta[len(delta)-1].Retain > 0 {
+		delta = delta[:len(delta)-1]
+	}
+	return delta
+}
+
+// changedItems returns the items holding the characters inserted or deleted by the transaction, in document order
+//
+// The items are found with the id index, and ordered by the number of characters before them
+func (doc *Doc) changedItems(tx *transaction) []*linkedItem {
+	seen := make(map[*linkedItem]bool)
+	var changed []*linkedItem
+	for _, ids := range []deleteSet{tx.inserted, tx.deleted} {
+		for client, ranges := range ids {
+			for _, r := range ranges {
+				for _, linked_item := range doc.content.itemsIn(client, r) {
+					if !seen[linked_item] {
+						seen[linked_item] = true
+						changed = append(changed, linked_item)
+					}
+				}
+			}
+		}
+	}
+	positions := make(map[*linkedItem]int, len(changed))
+	for _, linked_item := range changed {
+		positions[linked_item] = doc.content.sizeBefore(linked_item)
+	}
+	slices.SortFunc(changed, func(a, b *linkedItem) int { return positions[a] - positions[b] })
+	return changed
+}
+
+// segments splits the ids of the item at the boundaries of the version from before the transaction
+// and of the delete set of the transaction, so that every segment is changed as a whole
+func (tx *transaction) segments(item Item) []seqRange {
+	end := item.id.seq + Seq(item.length)
+	var inserted []seqRange
+	if seq, ok := tx.before[item.id.client]; ok && item.id.seq < seq+1 && seq+1 < end {
+		inserted = append(inserted, seqRange{start: seq + 1, length: int(end - seq - 1)})
+	}
+	return segmentRanges(item, inserted, tx.deleted.intersect(item.id.client, item.id.seq, item.length))
+}
+
+// appendDeltaOp appends the operation to the delta, merging it with the last operation of the same kind
+func appendDeltaOp(delta []DeltaOp, op DeltaOp) []DeltaOp {
+	if len(delta) > 0 {
+		last := &delta[len(delta)-1]
+		switch {
+		case op.Retain > 0 && last.Retain > 0:
+			last.Retain += op.Retain
+			return delta
+		case op.Insert != "" && last.Insert != "":
+			last.Insert += op.Insert
+			return delta
+		case op.Delete > 0 && last.Delete > 0:
+			last.Delete += op.Delete
+			return delta
+		}
+	}
+	return append(delta, op)
+}
@@ -0,0 +1,113 @@
+package fugue
+
+import (
+	"bytes"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// applyDelta applies the delta to the text
+func applyDelta(text string, delta []DeltaOp) string {
+	runes := []rune(text)
+	var result []rune
+	position := 0
+	for _, op := range delta {
+		switch {
+		case op.Retain > 0:
+			result = append(result, runes[position:position+op.Retain]...)
+			position += op.Retain
+		case op.Insert != "":
+			result = append(result, []rune(op.Insert)...)
+		case op.Embed != nil:
+			result = append(result, []rune(embedContent)...)
+		case op.Delete > 0:
+			position += op.Delete
+		}
+	}
+	return string(append(result, runes[position:]...))
+}
+
+// equalDeltas checks if the deltas have the same operations, comparing the payloads of the embeds
+func equalDeltas(a, b []DeltaOp) bool {
+	return slices.EqualFunc(a, b, func(x, y DeltaOp) bool {
+		return x.Retain == y.Retain && x.Insert == y.Insert && bytes.Equal(x.Embed, y.Embed) && x.Delete == y.Delete
+	})
+}
+
+func TestObserveLocal(t *testing.T) {
+	doc := NewDocWithClient(1)
+	var events []Event
+	unobserve := doc.Observe(func(event Event) { events = append(events, event) })
+	doc.Insert(0, "Hello world")
+	doc.Delete(5, 6)
+	doc.Insert(5, "!")
+	unobserve()
+	doc.Insert(0, "ignored")
+	expected := []Event{
+		{Delta: []DeltaOp{{Insert: "Hello world"}}, Local: true},
+		{Delta: []DeltaOp{{Retain: 5}, {Delete: 6}}, Local: true},
+		{Delta: []DeltaOp{{Retain: 5}, {Insert: "!"}}, Local: true},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	for i := range expected {
+		if events[i].Local != expected[i].Local || !equalDeltas(events[i].Delta, expected[i].Delta) {
+			t.Errorf("Unexpected event %d: %v, expected %v", i, events[i], expected[i])
+		}
+	}
+	// Failed operations do not send events
+	events = nil
+	doc.Observe(func(event Event) { events = append(events, event) })
+	doc.Delete(100, 1)
+	if len(events) != 0 {
+		t.Errorf("Unexpected events for a failed delete: %v", events)
+	}
+}
+
+func TestObserveRemote(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "abcdef")
+	syncDocs(t, doc1, doc2)
+	doc1.Delete(1, 2)
+	doc1.Insert(3, "XY")
+	var events []Event
+	doc2.Observe(func(event Event) { events = append(events, event) })
+	syncDocs(t, doc1, doc2)
+	expected := []DeltaOp{{Retain: 1}, {Delete: 2}, {Retain: 2}, {Insert: "XY"}}
+	if len(events) != 1 || events[0].Local || !equalDeltas(events[0].Delta, expected) {
+		t.Errorf("Unexpected events: %v, expected %v", events, expected)
+	}
+	// Applying the same update again changes nothing
+	syncDocs(t, doc1, doc2)
+	if len(events) != 1 {
+		t.Errorf("Unexpected events for an update without changes: %v", events[1:])
+	}
+}
+
+func TestObserveFuzzer(t *testing.T) {
+	const trials int64 = 100
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		texts := make([]string, len(docs))
+		for j, doc := range docs {
+			doc.Observe(func(event Event) { texts[j] = applyDelta(texts[j], event.Delta) })
+		}
+		for range 200 {
+			j := rng.Intn(len(docs))
+			randomEdit(t, rng, docs[j])
+			if rng.Float32() < 0.2 {
+				k := rng.Intn(len(docs))
+				syncDocs(t, docs[j], docs[k])
+			}
+			for k := range docs {
+				if texts[k] != docs[k].Text() {
+					t.Fatalf("Trial %d: text from events '%s', doc %d='%s'", i, texts[k], k, docs[k].Text())
+				}
+			}
+		}
+	}
+}
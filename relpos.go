@@ -0,0 +1,143 @@
+package fugue
+
+import (
+	"fmt"
+)
+
+// Assoc tells to which side of a position a RelativePosition sticks
+type Assoc int8
+
+const (
+	AssocRight Assoc = iota // the position sticks to the character after it
+	AssocLeft               // the position sticks to the character before it
+)
+
+// RelativePosition is a position in the document anchored to a character instead of an index,
+// so that it keeps pointing to the same place when concurrent edits happen before it
+//
+// A position anchored to a character that is deleted later stays where the character was
+type RelativePosition struct {
+	id    *Id // the character the position sticks to, nil for the start or the end of the document
+	assoc Assoc
+}
+
+// RelativePositionAt creates a relative position for the given visible position
+//
+// With AssocRight the position sticks to the character at the position, or to the end of the document.
+// With AssocLeft it sticks to the character before the position, or to the start of the document.
+// returns an error if the position is out of bounds or inside a character
+func (doc *Doc) RelativePositionAt(position int, assoc Assoc) (RelativePosition, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	position, err := doc.toRunes(position)
+	if err != nil {
+		return RelativePosition{}, err
+	}
+	return doc.relativePosition(position, assoc), nil
+}
+
+// AbsolutePosition returns the current visible position of the relative position
+//
+// returns an error if the character the position sticks to is not in the document
+func (doc *Doc) AbsolutePosition(rp RelativePosition) (int, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	position, err := doc.absolutePosition(rp)
+	if err != nil {
+		return -1, err
+	}
+	return doc.fromRunes(position), nil
+}
+
+// relativePosition creates a relative position for the given visible position in runes,
+// which must be in the bounds of the document
+func (doc *Doc) relativePosition(position int, assoc Assoc) RelativePosition {
+	anchor := position
+	if assoc == AssocLeft {
+		anchor--
+	}
+	if anchor < 0 || anchor == doc.content.visibleLength(UnitRune) {
+		// The position sticks to the start or the end of the document
+		return RelativePosition{assoc: assoc}
+	}
+	linked_item, item_position, _ := doc.findItemAt(anchor, false)
+	return RelativePosition{
+		id: &Id{
+			client: linked_item.item.id.client,
+			seq:    linked_item.item.id.seq + Seq(item_position),
+		},
+		assoc: assoc,
+	}
+}
+
+// absolutePosition returns the current visible position of the relative position in runes
+//
+// returns an error if the character the position sticks to is not in the document
+func (doc *Doc) absolutePosition(rp RelativePosition) (int, error) {
+	if rp.id == nil {
+		if rp.assoc == AssocLeft {
+			return 0, nil
+		}
+		return doc.content.visibleLength(UnitRune), nil
+	}
+	linked_item, _, err := doc.findItemFromId(rp.id)
+	if err != nil {
+		return -1, fmt.Errorf("error finding the anchor of the position: %w", err)
+	}
+	position := doc.content.visibleBefore(linked_item)[UnitRune]
+	if !linked_item.item.deleted {
+		position += int(rp.id.seq - linked_item.item.id.seq)
+		if rp.assoc == AssocLeft {
+			// The position is right after the character
+			position++
+		}
+	}
+	return position, nil
+}
+
+// Encode encodes the relative position, so that it can be sent to other replicas
+func (rp RelativePosition) Encode() []byte {
+	enc := encoder{}
+	enc.writeByte(formatVersion)
+	enc.writeRelativePosition(rp)
+	return enc.buf
+}
+
+// DecodeRelativePosition decodes a relative position produced by Encode
+//
+// returns an error if the data is malformed
+func DecodeRelativePosition(data []byte) (RelativePosition, error) {
+	dec := decoder{buf: data}
+	dec.readFormatVersion()
+	rp := dec.readRelativePosition()
+	if err := dec.finish(); err != nil {
+		return RelativePosition{}, fmt.Errorf("error decoding relative position: %w", err)
+	}
+	return rp, nil
+}
+
+func (enc *encoder) writeRelativePosition(rp RelativePosition) {
+	enc.writeByte(byte(rp.assoc))
+	if rp.id == nil {
+		enc.writeByte(0)
+	} else {
+		enc.writeByte(1)
+		enc.writeClient(rp.id.client)
+		enc.writeUvarint(uint64(rp.id.seq))
+	}
+}
+
+func (dec *decoder) readRelativePosition() RelativePosition {
+	rp := RelativePosition{assoc: Assoc(dec.readByte())}
+	if rp.assoc != AssocLeft && rp.assoc != AssocRight {
+		dec.fail("unknown assoc %d", rp.assoc)
+	}
+	if has_id := dec.readByte(); has_id == 1 {
+		client := dec.readClient()
+		seq := dec.readSeq()
+		rp.id = &Id{client: client, seq: seq}
+	} else if has_id != 0 {
+		dec.fail("invalid anchor flag %d", has_id)
+	}
+	return rp
+}
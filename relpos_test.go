@@ -0,0 +1,84 @@
+package fugue
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRelativePosition(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello world")
+	syncDocs(t, doc1, doc2)
+	// Carets around the space between the two words
+	before, _ := doc1.RelativePositionAt(5, AssocLeft)
+	after, _ := doc1.RelativePositionAt(6, AssocRight)
+	start, _ := doc1.RelativePositionAt(0, AssocLeft)
+	end, _ := doc1.RelativePositionAt(11, AssocRight)
+	check := func(rp RelativePosition, expected int) {
+		t.Helper()
+		position, err := doc1.AbsolutePosition(rp)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if position != expected {
+			t.Errorf("Unexpected position %d, expected %d", position, expected)
+		}
+	}
+	check(before, 5)
+	check(after, 6)
+	// Concurrent inserts before the positions move them
+	doc2.Insert(0, "Oh, ")
+	doc1.Insert(11, "!")
+	syncDocs(t, doc1, doc2)
+	syncDocs(t, doc2, doc1)
+	check(before, 9)
+	check(after, 10)
+	check(start, 0)
+	check(end, 16)
+	// Inserting at the position only moves the position sticking to the right
+	doc1.Insert(9, "_")
+	check(before, 9)
+	check(after, 11)
+	// The positions stay where their anchors were once deleted
+	doc2.Delete(8, 4)
+	syncDocs(t, doc2, doc1)
+	if doc1.Text() != "Oh, Hell_rld!" {
+		t.Fatalf("Unexpected content: '%s'", doc1.Text())
+	}
+	check(before, 8)
+	check(after, 9)
+}
+
+func TestRelativePositionEncoding(t *testing.T) {
+	doc := NewDocWithClient(1)
+	doc.Insert(0, "abc")
+	for _, position := range []int{0, 1, 3} {
+		for _, assoc := range []Assoc{AssocLeft, AssocRight} {
+			rp, err := doc.RelativePositionAt(position, assoc)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			decoded, err := DecodeRelativePosition(rp.Encode())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if absolute, _ := doc.AbsolutePosition(decoded); absolute != position {
+				t.Errorf("Unexpected position %d after decoding, expected %d", absolute, position)
+			}
+		}
+	}
+	if _, err := DecodeRelativePosition([]byte{formatVersion, 0, 2}); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Unexpected error for a malformed position: %v", err)
+	}
+	// A position anchored to a character that has not been received yet cannot be resolved
+	other := NewDocWithClient(2)
+	other.Insert(0, "x")
+	rp, _ := other.RelativePositionAt(0, AssocRight)
+	if _, err := doc.AbsolutePosition(rp); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unexpected error for an unknown anchor: %v", err)
+	}
+	if _, err := doc.RelativePositionAt(4, AssocRight); err == nil {
+		t.Errorf("Expected an error for an out of bounds position")
+	}
+}
@@ -0,0 +1,461 @@
+package fugue
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A Sequence orders its elements with the same items as a Doc: every element is a placeholder character of a document,
+// so that the elements are integrated without interleaving like text, and the values of the elements are kept aside,
+// in runs of consecutive seqs of a client. The values of an id never change, so they are only sent with their items,
+// in their JSON encoding. The document reaches the values through the elementValues interface, so that it syncs them
+// without knowing their type.
+//
+// The items are deliberately not generic over the values: keeping a single item type lets the sequences share
+// the integration, the tree, the id index, the GC, the binary encoding and the container roots
+// of the text, and lets a container root hold the values of a sequence before knowing their type. The cost is
+// that the values must be encodable with encoding/json, as they cross the document in that form, and that values
+// which cannot be encoded, such as channels or functions, are rejected by Insert.
+
+// sequenceElement is the placeholder character of an element in the document of a sequence
+const sequenceElement = "\x00"
+
+// Sequence is a replica of a collaborative list of values, such as todo items, slides or table rows
+//
+// Values are sent to the other replicas in their JSON encoding, so T must be encodable with encoding/json,
+// and values inserted by pointer must not be modified afterwards.
+// A Sequence can be used by several goroutines at once
+type Sequence[T any] struct {
+	doc    *Doc           // document ordering the elements, which also guards the values
+	values *valueStore[T] // values of the elements, also reached by the document
+}
+
+// valueRun holds the values of consecutive seqs of a client
+type valueRun[T any] struct {
+	start  Seq
+	values []T
+}
+
+// encodedRun holds the JSON encoding of the values of consecutive seqs of a client, as sent in updates
+type encodedRun struct {
+	id     Id // id of the first value
+	values []json.RawMessage
+}
+
+// elementValues holds the values of the elements of a sequence for the document ordering them
+type elementValues interface {
+	// encode returns the JSON encoding of the known values of the items, cropped to the ids of the items
+	//
+	// Collected items have no values, their elements being deleted for every replica.
+	// returns an error, along with the values that could be encoded, if a value cannot be encoded
+	encode(items []Item) ([]encodedRun, error)
+	// decode decodes the values of an update
+	//
+	// returns a function storing the values, or ErrInvalidEncoding if a value cannot be decoded
+	decode(runs []encodedRun) (store func(), err error)
+	// drop forgets the values of the range of ids of the client, whose items were collected
+	drop(client Client, r seqRange)
+}
+
+// valueStore holds the values of the elements of a sequence, by client
+type valueStore[T any] struct {
+	runs    map[Client][]valueRun[T] // values of the elements of every client, sorted by seq
+	invalid map[Id]json.RawMessage   // values that could not be decoded as T when a root was read as a sequence
+}
+
+// newValueStore creates an empty store
+func newValueStore[T any]() *valueStore[T] {
+	return &valueStore[T]{runs: make(map[Client][]valueRun[T]), invalid: make(map[Id]json.RawMessage)}
+}
+
+// NewSequence creates an empty sequence whose local edits are made by a new random client
+func NewSequence[T any]() *Sequence[T] {
+	return NewSequenceWithClient[T](RandomClient())
+}
+
+// NewSequenceWithClient creates an empty sequence whose local edits are made by the given client
+//
+// Every replica editing the same sequence must use a different client
+func NewSequenceWithClient[T any](client Client) *Sequence[T] {
+	doc := NewDocWithClient(client)
+	values := newValueStore[T]()
+	doc.elements = values
+	return &Sequence[T]{doc: doc, values: values}
+}
+
+// Client returns the client owning the local edits of the sequence
+func (s *Sequence[T]) Client() Client {
+	return s.doc.Client()
+}
+
+// Version returns the version of the sequence
+func (s *Sequence[T]) Version() Version {
+	return s.doc.Version()
+}
+
+// Len returns the number of elements of the sequence
+func (s *Sequence[T]) Len() int {
+	s.doc.mu.RLock()
+	defer s.doc.mu.RUnlock()
+	return s.doc.content.visibleLength(UnitRune)
+}
+
+// Get returns the value at the given position
+//
+// returns an error if the position is out of bounds,
+// or ErrInvalidEncoding if the value was received before the root was read as a sequence of T and is not a T
+func (s *Sequence[T]) Get(position int) (T, error) {
+	s.doc.mu.RLock()
+	defer s.doc.mu.RUnlock()
+	var zero T
+	linked_item, item_position, out_of_bound := s.doc.findItemAt(position, false)
+	if out_of_bound != nil {
+		return zero, out_of_bound
+	}
+	value, err := s.values.get(Id{client: linked_item.item.id.client, seq: linked_item.item.id.seq + Seq(item_position)})
+	if err != nil {
+		return zero, fmt.Errorf("value at %d: %w", position, err)
+	}
+	return value, nil
+}
+
+// Values returns the values of the sequence, in order
+//
+// returns ErrInvalidEncoding if a value was received before the root was read as a sequence of T and is not a T
+func (s *Sequence[T]) Values() ([]T, error) {
+	s.doc.mu.RLock()
+	defer s.doc.mu.RUnlock()
+	values := make([]T, 0, s.doc.content.visibleLength(UnitRune))
+	for linked_item := s.doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		if linked_item.item.deleted {
+			continue
+		}
+		for i := range linked_item.item.length {
+			value, err := s.values.get(Id{client: linked_item.item.id.client, seq: linked_item.item.id.seq + Seq(i)})
+			if err != nil {
+				return nil, fmt.Errorf("value at %d: %w", len(values), err)
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Insert inserts the values at the given position
+//
+// returns an error if the position is out of bounds or if a value cannot be encoded
+func (s *Sequence[T]) Insert(position int, values ...T) error {
+	if len(values) == 0 {
+		return nil
+	}
+	// Values are encoded when they are sent, make sure that they can be
+	for _, value := range values {
+		if _, err := json.Marshal(value); err != nil {
+			return fmt.Errorf("error encoding value: %w", err)
+		}
+	}
+	doc := s.doc
+	return doc.transact(true, func() error {
+		client := doc.client
+		start := doc.nextSeq(client)
+		if err := doc.localInsert(client, position, Content(strings.Repeat(sequenceElement, len(values))), nil); err != nil {
+			return err
+		}
+		s.values.store(client, start, slices.Clone(values))
+		return nil
+	})
+}
+
+// Delete deletes the given number of elements starting at the given position
+//
+// returns an error if the range is out of bounds
+func (s *Sequence[T]) Delete(position int, length int) error {
+	return s.doc.transact(true, func() error {
+		return s.doc.localDelete(position, length)
+	})
+}
+
+// EncodeStateVector encodes the version of the sequence so that a peer can
+// compute the changes this sequence is missing with EncodeDiff
+func (s *Sequence[T]) EncodeStateVector() []byte {
+	return s.doc.EncodeStateVector()
+}
+
+// EncodeDiff encodes the changes of the sequence that are not in the given state vector, with their values
+//
+// An empty state vector encodes the whole sequence.
+// returns an error if the state vector is malformed or if a value cannot be encoded
+func (s *Sequence[T]) EncodeDiff(state_vector []byte) ([]byte, error) {
+	return s.doc.EncodeDiff(state_vector)
+}
+
+// EncodeState encodes the whole sequence as an update, which can be persisted
+// and loaded back by applying it to an empty sequence
+//
+// returns an error if a value cannot be encoded
+func (s *Sequence[T]) EncodeState() ([]byte, error) {
+	return s.EncodeDiff(nil)
+}
+
+// ApplyUpdate applies an update produced by EncodeDiff on another sequence
+//
+// The update is applied all-or-nothing, as for a Doc.
+// returns ErrInvalidEncoding if the update is malformed, if it is not made of elements
+// or if its values cannot be decoded as T, or the errors of Doc.ApplyUpdate
+func (s *Sequence[T]) ApplyUpdate(data []byte) error {
+	upd, err := decodeUpdate(data)
+	if err != nil {
+		return fmt.Errorf("error decoding update: %w", err)
+	}
+	if err := checkElements(upd); err != nil {
+		return fmt.Errorf("error decoding update: %w", err)
+	}
+	return s.doc.transact(false, func() error {
+		return s.doc.applyUpdate(upd)
+	})
+}
+
+// Merge merges the changes of the other sequence into this sequence
+//
+// returns an error if the changes cannot be applied
+func (s *Sequence[T]) Merge(from *Sequence[T]) error {
+	diff, err := from.EncodeDiff(s.EncodeStateVector())
+	if err != nil {
+		return err
+	}
+	return s.ApplyUpdate(diff)
+}
+
+// checkElements checks that the items of the update are elements, with values for every element
+//
+// returns ErrInvalidEncoding otherwise
+func checkElements(upd *update) error {
+	ids := make(deleteSet)
+	for _, run := range upd.values {
+		ids.add(run.id.client, run.id.seq, len(run.values))
+	}
+	for _, item := range upd.items {
+		if item.collected() {
+			continue
+		}
+		if string(item.content) != strings.Repeat(sequenceElement, item.length) || item.embed != nil {
+			return fmt.Errorf("%w: item %d:%d is not made of elements", ErrInvalidEncoding, item.id.client, item.id.seq)
+		}
+		if len(ids.complement(item.id.client, item.id.seq, item.length)) > 0 {
+			return fmt.Errorf("%w: item %d:%d has no values", ErrInvalidEncoding, item.id.client, item.id.seq)
+		}
+	}
+	return nil
+}
+
+// encodeValues sets the values of the items of the update, if the document orders the elements of a sequence
+//
+// returns an error, along with the values that could be encoded, if a value cannot be encoded
+func (doc *Doc) encodeValues(upd *update) error {
+	if doc.elements == nil {
+		return nil
+	}
+	var err error
+	upd.values, err = doc.elements.encode(upd.items)
+	return err
+}
+
+// compareRunStart compares the first seq of the run with the seq
+func compareRunStart[T any](run valueRun[T], seq Seq) int {
+	return cmp.Compare(run.start, seq)
+}
+
+// value returns the value of the element with the given id
+//
+// returns false if the value is not known
+func (vs *valueStore[T]) value(id Id) (T, bool) {
+	runs := vs.runs[id.client]
+	i, found := slices.BinarySearchFunc(runs, id.seq, compareRunStart[T])
+	if !found {
+		i--
+	}
+	if i < 0 || id.seq >= runs[i].start+Seq(len(runs[i].values)) {
+		var zero T
+		return zero, false
+	}
+	return runs[i].values[id.seq-runs[i].start], true
+}
+
+// get returns the value of the element with the given id
+//
+// returns ErrInvalidEncoding if the value is not a T, or ErrNotFound if it is not known
+func (vs *valueStore[T]) get(id Id) (T, error) {
+	value, ok := vs.value(id)
+	switch {
+	case ok:
+		return value, nil
+	case vs.invalid[id] != nil:
+		return value, fmt.Errorf("%w: value of %d:%d", ErrInvalidEncoding, id.client, id.seq)
+	default:
+		return value, fmt.Errorf("%w: value of %d:%d", ErrNotFound, id.client, id.seq)
+	}
+}
+
+// store stores the values of consecutive seqs of the client starting at start,
+// skipping the seqs whose values are already known
+func (vs *valueStore[T]) store(client Client, start Seq, values []T) {
+	for i := 0; i < len(values); {
+		if _, ok := vs.value(Id{client: client, seq: start + Seq(i)}); ok {
+			i++
+			continue
+		}
+		// Store the run of unknown values
+		end := i + 1
+		for end < len(values) {
+			if _, ok := vs.value(Id{client: client, seq: start + Seq(end)}); ok {
+				break
+			}
+			end++
+		}
+		run := valueRun[T]{start: start + Seq(i), values: values[i:end]}
+		j, _ := slices.BinarySearchFunc(vs.runs[client], run.start, compareRunStart[T])
+		vs.runs[client] = slices.Insert(vs.runs[client], j, run)
+		i = end
+	}
+}
+
+// encode implements elementValues, encoding the values element by element
+//
+// Values that could not be decoded as T are sent as they were received
+func (vs *valueStore[T]) encode(items []Item) ([]encodedRun, error) {
+	var runs []encodedRun
+	var first error
+	for _, item := range items {
+		if item.collected() {
+			continue
+		}
+		var run *encodedRun
+		for i := range item.length {
+			id := Id{client: item.id.client, seq: item.id.seq + Seq(i)}
+			raw := vs.invalid[id]
+			if value, ok := vs.value(id); ok {
+				var err error
+				if raw, err = json.Marshal(value); err != nil {
+					first = cmp.Or(first, fmt.Errorf("error encoding value of %d:%d: %w", id.client, id.seq, err))
+					raw = nil
+				}
+			}
+			switch {
+			case raw == nil:
+				run = nil
+			case run == nil:
+				runs = append(runs, encodedRun{id: id, values: []json.RawMessage{raw}})
+				run = &runs[len(runs)-1]
+			default:
+				run.values = append(run.values, raw)
+			}
+		}
+	}
+	return runs, first
+}
+
+// decode implements elementValues
+func (vs *valueStore[T]) decode(runs []encodedRun) (func(), error) {
+	decoded := make([]valueRun[T], len(runs))
+	for i, run := range runs {
+		decoded[i] = valueRun[T]{start: run.id.seq, values: make([]T, len(run.values))}
+		for j, raw := range run.values {
+			if err := json.Unmarshal(raw, &decoded[i].values[j]); err != nil {
+				return nil, fmt.Errorf("%w: value of %d:%d: %w", ErrInvalidEncoding, run.id.client, run.id.seq+Seq(j), err)
+			}
+		}
+	}
+	return func() {
+		for i, run := range runs {
+			vs.store(run.id.client, decoded[i].start, decoded[i].values)
+		}
+	}, nil
+}
+
+// drop implements elementValues, splitting the runs overlapping the range
+func (vs *valueStore[T]) drop(client Client, r seqRange) {
+	var kept []valueRun[T]
+	for _, run := range vs.runs[client] {
+		end := run.start + Seq(len(run.values))
+		if end <= r.start || run.start >= r.end() {
+			kept = append(kept, run)
+			continue
+		}
+		if run.start < r.start {
+			kept = append(kept, valueRun[T]{start: run.start, values: run.values[:r.start-run.start]})
+		}
+		if end > r.end() {
+			kept = append(kept, valueRun[T]{start: r.end(), values: run.values[r.end()-run.start:]})
+		}
+	}
+	vs.runs[client] = kept
+	for seq := r.start; seq < r.end() && len(vs.invalid) > 0; seq++ {
+		delete(vs.invalid, Id{client: client, seq: seq})
+	}
+}
+
+// load decodes the values held by another store of the document, keeping the values that are not a T as invalid
+func (vs *valueStore[T]) load(doc *Doc, from elementValues) {
+	items := slices.Clone(doc.pending)
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		items = append(items, linked_item.items()...)
+	}
+	// The values held by the other store were encodable when they were inserted
+	runs, _ := from.encode(items)
+	for _, run := range runs {
+		for i, raw := range run.values {
+			id := Id{client: run.id.client, seq: run.id.seq + Seq(i)}
+			var value T
+			if err := json.Unmarshal(raw, &value); err != nil {
+				vs.invalid[id] = raw
+				continue
+			}
+			vs.store(id.client, id.seq, []T{value})
+		}
+	}
+}
+
+func (enc *encoder) writeValues(values []encodedRun) {
+	enc.writeUvarint(uint64(len(values)))
+	for _, run := range values {
+		enc.writeClient(run.id.client)
+		enc.writeUvarint(uint64(run.id.seq))
+		enc.writeUvarint(uint64(len(run.values)))
+		for _, raw := range run.values {
+			enc.writeString(string(raw))
+		}
+	}
+}
+
+func (dec *decoder) readValues() []encodedRun {
+	count := dec.readLength()
+	values := make([]encodedRun, 0, count)
+	for range count {
+		var run encodedRun
+		run.id.client = dec.readClient()
+		run.id.seq = dec.readSeq()
+		length := dec.readLength()
+		if length == 0 || int64(run.id.seq)+int64(length) > int64(maxSeq)+1 {
+			dec.fail("invalid values of length %d at %d", length, run.id.seq)
+		}
+		for range length {
+			raw := dec.readString()
+			if dec.err != nil {
+				return nil
+			}
+			if !json.Valid([]byte(raw)) {
+				dec.fail("invalid value of %d:%d", run.id.client, run.id.seq)
+				return nil
+			}
+			run.values = append(run.values, json.RawMessage(raw))
+		}
+		if dec.err != nil {
+			return nil
+		}
+		values = append(values, run)
+	}
+	return values
+}
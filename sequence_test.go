@@ -0,0 +1,179 @@
+package fugue
+
+import (
+	"errors"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+type todo struct {
+	Title string `json:"title"`
+	Done  bool   `json:"done"`
+}
+
+// syncSequences merges the changes of each sequence into the other
+func syncSequences[T any](t *testing.T, seq1 *Sequence[T], seq2 *Sequence[T]) {
+	t.Helper()
+	if err := seq1.Merge(seq2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := seq2.Merge(seq1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// sequenceValues returns the values of the sequence, failing the test if they cannot be decoded
+func sequenceValues[T any](t *testing.T, seq *Sequence[T]) []T {
+	t.Helper()
+	values, err := seq.Values()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return values
+}
+
+func TestSequence(t *testing.T) {
+	seq1 := NewSequenceWithClient[todo](1)
+	seq2 := NewSequenceWithClient[todo](2)
+	seq1.Insert(0, todo{Title: "milk"}, todo{Title: "eggs"})
+	syncSequences(t, seq1, seq2)
+	// Concurrent inserts at the same position are not interleaved
+	seq1.Insert(1, todo{Title: "bread"}, todo{Title: "butter"})
+	seq2.Insert(1, todo{Title: "apples", Done: true}, todo{Title: "pears"})
+	seq2.Delete(0, 1)
+	syncSequences(t, seq1, seq2)
+	expected := []todo{{Title: "bread"}, {Title: "butter"}, {Title: "apples", Done: true}, {Title: "pears"}, {Title: "eggs"}}
+	if !slices.Equal(sequenceValues(t, seq1), expected) || !slices.Equal(sequenceValues(t, seq2), expected) {
+		t.Fatalf("Unexpected values: %v and %v", sequenceValues(t, seq1), sequenceValues(t, seq2))
+	}
+	if seq1.Len() != 5 {
+		t.Errorf("Unexpected length %d", seq1.Len())
+	}
+	if value, err := seq2.Get(2); err != nil || value != (todo{Title: "apples", Done: true}) {
+		t.Errorf("Unexpected value %v: %v", value, err)
+	}
+	var out_of_bound *OutOfBoundErr
+	if _, err := seq1.Get(5); !errors.As(err, &out_of_bound) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := seq1.Insert(6, todo{}); err == nil {
+		t.Errorf("Expected an error for an insert out of bounds")
+	}
+	// The state is loaded back with its values
+	state, err := seq1.EncodeState()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	loaded := NewSequenceWithClient[todo](3)
+	if err := loaded.ApplyUpdate(state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !slices.Equal(sequenceValues(t, loaded), expected) {
+		t.Errorf("Unexpected values after loading: %v", sequenceValues(t, loaded))
+	}
+	// Applying the same update again changes nothing
+	if err := loaded.ApplyUpdate(state); err != nil || !slices.Equal(sequenceValues(t, loaded), expected) {
+		t.Errorf("Unexpected values after applying the state twice: %v: %v", sequenceValues(t, loaded), err)
+	}
+	// Values of another type are rejected
+	if err := NewSequenceWithClient[int](4).ApplyUpdate(state); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Unexpected error for values of another type: %v", err)
+	}
+	// Text updates are not sequence updates
+	doc := NewDocWithClient(5)
+	doc.Insert(0, "abc")
+	if err := NewSequenceWithClient[string](6).ApplyUpdate(doc.EncodeState()); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Unexpected error for a text update: %v", err)
+	}
+}
+
+func TestSequenceOutOfOrder(t *testing.T) {
+	seq1 := NewSequenceWithClient[int](1)
+	seq2 := NewSequenceWithClient[int](2)
+	seq1.Insert(0, 1, 2, 3)
+	first, _ := seq1.EncodeState()
+	vector := seq1.EncodeStateVector()
+	seq1.Insert(3, 4, 5)
+	second, _ := seq1.EncodeDiff(vector)
+	// The second update waits for the first one, keeping its values
+	if err := seq2.ApplyUpdate(second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if seq2.Len() != 0 {
+		t.Fatalf("Unexpected values: %v", sequenceValues(t, seq2))
+	}
+	if err := seq2.ApplyUpdate(first); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !slices.Equal(sequenceValues(t, seq2), []int{1, 2, 3, 4, 5}) {
+		t.Errorf("Unexpected values: %v", sequenceValues(t, seq2))
+	}
+}
+
+// note has an unexported field, which is not encoded
+type note struct {
+	Text  string `json:"text"`
+	draft bool
+}
+
+func TestSequenceLocalValues(t *testing.T) {
+	seq1 := NewSequenceWithClient[*note](1)
+	seq2 := NewSequenceWithClient[*note](2)
+	first := &note{Text: "a", draft: true}
+	seq1.Insert(0, first)
+	// Local values are kept as they were inserted
+	if value, err := seq1.Get(0); err != nil || value != first || !value.draft {
+		t.Errorf("Unexpected value %v: %v", value, err)
+	}
+	// Remote values are decoded from their JSON encoding
+	syncSequences(t, seq1, seq2)
+	if value, err := seq2.Get(0); err != nil || value == first || *value != (note{Text: "a"}) {
+		t.Errorf("Unexpected remote value %v: %v", value, err)
+	}
+	// Values that cannot be encoded are rejected
+	if err := NewSequenceWithClient[func()](3).Insert(0, func() {}); err == nil {
+		t.Errorf("Expected an error for a value that cannot be encoded")
+	}
+}
+
+func TestSequenceFuzzer(t *testing.T) {
+	const trials int64 = 50
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		seqs := []*Sequence[int]{NewSequenceWithClient[int](0), NewSequenceWithClient[int](1), NewSequenceWithClient[int](2)}
+		// The values of every replica follow the local edits of the replica
+		values := make([][]int, len(seqs))
+		for step := range 200 {
+			j := rng.Intn(len(seqs))
+			position, length := randomChange(rng, seqs[j].Len())
+			if length == 0 {
+				inserted := make([]int, 1+rng.Intn(3))
+				for k := range inserted {
+					inserted[k] = step*10 + k
+				}
+				if err := seqs[j].Insert(position, inserted...); err != nil {
+					t.Fatalf("Trial %d: unexpected error: %v", i, err)
+				}
+				values[j] = slices.Insert(values[j], position, inserted...)
+			} else {
+				if err := seqs[j].Delete(position, length); err != nil {
+					t.Fatalf("Trial %d: unexpected error: %v", i, err)
+				}
+				values[j] = slices.Delete(values[j], position, position+length)
+			}
+			if !slices.Equal(sequenceValues(t, seqs[j]), values[j]) {
+				t.Fatalf("Trial %d: sequence %d=%v, expected %v", i, j, sequenceValues(t, seqs[j]), values[j])
+			}
+			if rng.Float32() < 0.3 {
+				k := rng.Intn(len(seqs))
+				syncSequences(t, seqs[j], seqs[k])
+				values[j] = sequenceValues(t, seqs[j])
+				values[k] = sequenceValues(t, seqs[k])
+				if !slices.Equal(values[j], values[k]) {
+					t.Fatalf("Trial %d: sequences %d and %d diverged: %v and %v", i, j, k, values[j], values[k])
+				}
+			}
+		}
+	}
+}
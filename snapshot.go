@@ -0,0 +1,106 @@
+package fugue
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// Snapshot is the state of a document at some point of its history:
+// the items of the version are inserted, and the ids of the delete set are deleted
+//
+// A snapshot is small, since the content of the past states is read from the items of the document,
+// tombstones included, as long as it has not been collected by the GC.
+type Snapshot struct {
+	version Version
+	deleted deleteSet
+}
+
+// Snapshot captures the current state of the document
+func (doc *Doc) Snapshot() Snapshot {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return Snapshot{version: maps.Clone(doc.version), deleted: doc.deleted.clone()}
+}
+
+// Version returns the version of the snapshot
+func (snapshot Snapshot) Version() Version {
+	return maps.Clone(snapshot.version)
+}
+
+// ContentAt returns the visible text of the document at the time of the snapshot
+//
+// The items of the document are walked once, keeping the characters that were inserted
+// and not yet deleted at that time.
+// returns ErrNotFound if the snapshot has items that are not in the document,
+// or ErrCollected if the GC dropped some of the characters visible in the snapshot
+func (doc *Doc) ContentAt(snapshot Snapshot) (string, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.contentAt(snapshot)
+}
+
+// contentAt returns the visible text of the document at the time of the snapshot
+//
+// returns an error if the snapshot has items that are not in the document or content that was collected
+func (doc *Doc) contentAt(snapshot Snapshot) (string, error) {
+	if err := doc.checkSnapshot(snapshot); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		for _, item := range linked_item.items() {
+			for _, r := range snapshot.visible(item) {
+				if item.collected() {
+					return "", fmt.Errorf("%w: item %d:%d", ErrCollected, item.id.client, r.start)
+				}
+				sb.WriteString(string(contentRange(item, r.start, r.length)))
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+// checkSnapshot checks that the items of the snapshot are in the document
+//
+// returns ErrNotFound if some of them are missing
+func (doc *Doc) checkSnapshot(snapshot Snapshot) error {
+	for client, seq := range snapshot.version {
+		if !isInVersion(&Id{client: client, seq: seq}, &doc.version) {
+			return fmt.Errorf("%w: seq %d of client %d is not in the document", ErrNotFound, seq, client)
+		}
+	}
+	return nil
+}
+
+// visible returns the ranges of ids of the item that are visible in the snapshot
+func (snapshot Snapshot) visible(item Item) []seqRange {
+	seq, ok := snapshot.version[item.id.client]
+	if !ok || seq < item.id.seq {
+		return nil
+	}
+	length := min(item.length, int(seq-item.id.seq)+1)
+	return snapshot.deleted.complement(item.id.client, item.id.seq, length)
+}
+
+// Encode encodes the snapshot, so that it can be stored or sent to other replicas
+func (snapshot Snapshot) Encode() []byte {
+	enc := encoder{}
+	enc.writeByte(formatVersion)
+	enc.writeVersion(snapshot.version)
+	enc.writeDeleteSet(snapshot.deleted)
+	return enc.buf
+}
+
+// DecodeSnapshot decodes a snapshot produced by Encode
+//
+// returns an error if the data is malformed
+func DecodeSnapshot(data []byte) (Snapshot, error) {
+	dec := decoder{buf: data}
+	dec.readFormatVersion()
+	snapshot := Snapshot{version: dec.readVersion(), deleted: dec.readDeleteSet()}
+	if err := dec.finish(); err != nil {
+		return Snapshot{}, fmt.Errorf("error decoding snapshot: %w", err)
+	}
+	return snapshot, nil
+}
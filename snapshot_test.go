@@ -0,0 +1,78 @@
+package fugue
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello world")
+	first := doc1.Snapshot()
+	doc1.Delete(5, 6)
+	doc1.Insert(5, " there")
+	second := doc1.Snapshot()
+	doc1.Delete(0, 6)
+	syncDocs(t, doc1, doc2)
+	// Snapshots can be read on every replica with the items
+	decoded, err := DecodeSnapshot(second.Encode())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []struct {
+		snapshot Snapshot
+		text     string
+	}{{first, "Hello world"}, {second, "Hello there"}, {decoded, "Hello there"}, {doc1.Snapshot(), "there"}}
+	for i, e := range expected {
+		for _, doc := range []*Doc{doc1, doc2} {
+			if text, err := doc.ContentAt(e.snapshot); err != nil || text != e.text {
+				t.Errorf("Unexpected content of snapshot %d: '%s' %v, expected '%s'", i, text, err, e.text)
+			}
+		}
+	}
+	// A snapshot with items the document does not have cannot be read
+	if _, err := NewDocWithClient(3).ContentAt(first); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unexpected error for a snapshot of another document: %v", err)
+	}
+	// Collected content cannot be read
+	doc1.GC(MinVersion(doc1.Version(), doc2.Version()))
+	if _, err := doc1.ContentAt(first); !errors.Is(err, ErrCollected) {
+		t.Errorf("Unexpected error for collected content: %v", err)
+	}
+	if text, err := doc1.ContentAt(doc1.Snapshot()); err != nil || text != "there" {
+		t.Errorf("Unexpected content: '%s' %v", text, err)
+	}
+}
+
+func TestSnapshotFuzzer(t *testing.T) {
+	const trials int64 = 50
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		snapshots := make([]Snapshot, 0)
+		texts := make([]string, 0)
+		for range 200 {
+			doc := docs[rng.Intn(len(docs))]
+			randomEdit(t, rng, doc)
+			if rng.Float32() < 0.2 {
+				syncDocs(t, doc, docs[rng.Intn(len(docs))])
+			}
+			if rng.Float32() < 0.1 {
+				snapshots = append(snapshots, doc.Snapshot())
+				texts = append(texts, doc.Text())
+			}
+		}
+		for j := range docs {
+			for k := range docs {
+				syncDocs(t, docs[j], docs[k])
+			}
+		}
+		for k, snapshot := range snapshots {
+			if text, err := docs[0].ContentAt(snapshot); err != nil || text != texts[k] {
+				t.Fatalf("Trial %d: unexpected content of snapshot %d: '%s' %v, expected '%s'", i, k, text, err, texts[k])
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package fugue
+
+import (
+	"maps"
+	"slices"
+	"sort"
+)
+
+// transaction groups the changes made to the document by one operation
+type transaction struct {
+	local     bool       // whether the changes are made by the local client rather than received from a remote update
+	origin    any        // what started the transaction, if it is not the user
+	before    Version    // version of the document when the transaction started
+	inserted  deleteSet  // ids of the items integrated during the transaction
+	deleted   deleteSet  // ids deleted during the transaction
+	deletions []deletion // deletions integrated during the transaction, see deleteset.go
+	marks     []mark     // marks added during the transaction
+	entries   []entry    // entries of the map integrated during the transaction
+}
+
+// Tx is a transaction running on a document, grouping several changes
+// into one event and one update, see Doc.Transact
+//
+// A Tx must only be used by the function it is given to
+type Tx struct {
+	doc *Doc
+}
+
+// Transact runs the function with the document locked, so that all of its changes
+// are seen at once by the other goroutines, the observers and the other replicas
+//
+// The function must make its changes with the Tx, calling the methods of the document would deadlock.
+// The transaction is not rolled back if the function fails: the changes it made before returning
+// the error are kept, and sent to the observers and the other replicas like the others.
+// returns the error of the function
+func (doc *Doc) Transact(fn func(tx *Tx) error) error {
+	return doc.transact(true, func() error {
+		return fn(&Tx{doc: doc})
+	})
+}
+
+// Insert inserts the text at the given position, counted in the unit of the document
+//
+// returns an error if the position is out of bounds or inside a character
+func (tx *Tx) Insert(position int, text string) error {
+	if text == "" {
+		return nil
+	}
+	position, err := tx.doc.toRunes(position)
+	if err != nil {
+		return err
+	}
+	return tx.doc.localInsert(tx.doc.client, position, Content(text), nil)
+}
+
+// Delete deletes the text of the given length starting at the given position,
+// both counted in the unit of the document
+//
+// returns an error if the range is out of bounds or starts or ends inside a character
+func (tx *Tx) Delete(position int, length int) error {
+	if length <= 0 || tx.doc.unit == UnitRune {
+		return tx.doc.localDelete(position, length)
+	}
+	start, err := tx.doc.toRunes(position)
+	if err != nil {
+		return err
+	}
+	end, err := tx.doc.toRunes(position + length)
+	if err != nil {
+		return err
+	}
+	return tx.doc.localDelete(start, end-start)
+}
+
+// Text returns the visible text of the document, including the changes of the transaction
+func (tx *Tx) Text() string {
+	return string(tx.doc.getContent())
+}
+
+// Len returns the length of the visible text of the document in the unit of the document,
+// including the changes of the transaction
+func (tx *Tx) Len() int {
+	return tx.doc.content.visibleLength(tx.doc.unit)
+}
+
+// transact runs the function in a new transaction with the document locked,
+// then notifies the observers of the changes
+//
+// Observers are notified after the document is unlocked, so that they can read it,
+// and in the order of the transactions.
+// returns the error of the function
+func (doc *Doc) transact(local bool, fn func() error) error {
+	doc.mu.Lock()
+	doc.begin(local)
+	err := fn()
+	dispatch := doc.finish()
+	if dispatch == nil {
+		doc.mu.Unlock()
+		return err
+	}
+	doc.emit.push(dispatch)
+	doc.mu.Unlock()
+	doc.emit.run()
+	return err
+}
+
+// begin starts a transaction on the locked document
+func (doc *Doc) begin(local bool) {
+	doc.tx = &transaction{
+		local:    local,
+		before:   maps.Clone(doc.version),
+		inserted: make(deleteSet),
+		deleted:  make(deleteSet),
+	}
+}
+
+// finish ends the transaction of the locked document and notifies the internal observers
+//
+// The ids deleted by a local transaction are recorded as a deletion of the client of the document.
+// returns a function notifying the other observers, to call once the document is unlocked,
+// or nil if the transaction changed nothing
+func (doc *Doc) finish() func() {
+	doc.recordDeletion()
+	tx := doc.tx
+	doc.tx = nil
+	if !tx.changed() {
+		return nil
+	}
+	return doc.notify(tx)
+}
+
+// changed checks if the transaction inserted, deleted or formatted anything, or changed the map
+//
+// returns true if the document has been modified
+func (tx *transaction) changed() bool {
+	return len(tx.inserted) > 0 || len(tx.deleted) > 0 || len(tx.deletions) > 0 || len(tx.marks) > 0 || len(tx.entries) > 0
+}
+
+// update returns the changes made during the transaction, as an update for the other replicas
+//
+// The inserted items are found with the id index instead of a scan of the document
+func (tx *transaction) update(doc *Doc) *update {
+	upd := &update{deleted: tx.deleted.clone(), deletions: tx.deletions, marks: tx.marks, entries: slices.SortedFunc(slices.Values(tx.entries), compareEntryIds)}
+	for client, ranges := range tx.inserted {
+		items := doc.content.ids[client]
+		for _, r := range ranges {
+			// Start from the item containing the first inserted id
+			i := sort.Search(len(items), func(i int) bool { return items[i].item.id.seq > r.start }) - 1
+			version := Version{client: r.start - 1}
+			for i = max(i, 0); i < len(items) && items[i].item.id.seq < r.end(); i++ {
+				if cropped, err := cropOutVersion(items[i].item, &version); err == nil {
+					cropped.deleted = false
+					upd.items = append(upd.items, cropped)
+				}
+			}
+		}
+	}
+	// Values that cannot be encoded were rejected by Insert
+	doc.encodeValues(upd)
+	return upd
+}
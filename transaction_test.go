@@ -0,0 +1,150 @@
+package fugue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTransact(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello world")
+	syncDocs(t, doc1, doc2)
+	var events []Event
+	var updates [][]byte
+	doc1.Observe(func(event Event) { events = append(events, event) })
+	doc1.ObserveUpdates(func(update []byte, local bool) {
+		if !local {
+			t.Errorf("Unexpected remote update")
+		}
+		updates = append(updates, update)
+	})
+	err := doc1.Transact(func(tx *Tx) error {
+		if err := tx.Delete(5, 6); err != nil {
+			return err
+		}
+		if err := tx.Insert(5, ", wörld"); err != nil {
+			return err
+		}
+		return tx.Insert(tx.Len(), "!")
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []DeltaOp{{Retain: 5}, {Insert: ", wörld!"}, {Delete: 6}}
+	if len(events) != 1 || !equalDeltas(events[0].Delta, expected) {
+		t.Errorf("Unexpected events: %v, expected %v", events, expected)
+	}
+	// The update of the transaction is all the other replica is missing
+	if len(updates) != 1 {
+		t.Fatalf("Unexpected number of updates: %d", len(updates))
+	}
+	if err := doc2.ApplyUpdate(updates[0]); err != nil {
+		t.Fatalf("Unexpected error applying the update: %v", err)
+	}
+	if doc2.Text() != "Hello, wörld!" || doc2.Text() != doc1.Text() {
+		t.Errorf("Unexpected content: doc1='%s', doc2='%s'", doc1.Text(), doc2.Text())
+	}
+	// The error of the function is returned
+	failure := errors.New("failure")
+	if err := doc1.Transact(func(tx *Tx) error { return failure }); err != failure {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(updates) != 1 {
+		t.Errorf("Unexpected update of a transaction without changes")
+	}
+	// The edits made before the error are kept and sent
+	err = doc1.Transact(func(tx *Tx) error {
+		if err := tx.Insert(0, "zz"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if doc1.Text() != "zzHello, wörld!" {
+		t.Errorf("Unexpected content: '%s'", doc1.Text())
+	}
+	if len(events) != 2 || len(updates) != 2 {
+		t.Fatalf("Unexpected number of events and updates: %d, %d", len(events), len(updates))
+	}
+	if err := doc2.ApplyUpdate(updates[1]); err != nil {
+		t.Fatalf("Unexpected error applying the update: %v", err)
+	}
+	if doc2.Text() != doc1.Text() {
+		t.Errorf("Unexpected content: doc1='%s', doc2='%s'", doc1.Text(), doc2.Text())
+	}
+}
+
+func TestConcurrentDocs(t *testing.T) {
+	const writers = 4
+	const edits = 200
+	docs := make([]*Doc, writers)
+	for i := range docs {
+		docs[i] = NewDoc()
+	}
+	shared := NewDoc()
+	var received [][]byte
+	var mu sync.Mutex
+	shared.ObserveUpdates(func(update []byte, local bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, update)
+	})
+	// Observers read the document while other goroutines are changing it
+	events := 0
+	shared.Observe(func(event Event) {
+		_ = shared.Text()
+		mu.Lock()
+		defer mu.Unlock()
+		events++
+	})
+	var wg sync.WaitGroup
+	for i, doc := range docs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range edits {
+				doc.Insert(doc.Len(), fmt.Sprint(j%10))
+				shared.Transact(func(tx *Tx) error {
+					return tx.Insert(tx.Len()/2, string(rune('a'+i)))
+				})
+				// Documents are merged into each other at the same time
+				if j%20 == 0 {
+					docs[(i+1)%writers].Merge(doc)
+					doc.Merge(docs[(i+1)%writers])
+				}
+				_ = shared.Text()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, doc := range docs {
+		for _, other := range docs {
+			if err := doc.Merge(other); err != nil {
+				t.Fatalf("Unexpected error during merge: %v", err)
+			}
+		}
+	}
+	for _, doc := range docs[1:] {
+		if doc.Text() != docs[0].Text() {
+			t.Errorf("Documents diverged: '%s' and '%s'", doc.Text(), docs[0].Text())
+		}
+	}
+	if shared.Len() != writers*edits || events != writers*edits {
+		t.Errorf("Unexpected length of the shared document: %d after %d events", shared.Len(), events)
+	}
+	// The updates rebuild the shared document
+	copied := NewDoc()
+	for _, update := range received {
+		if err := copied.ApplyUpdate(update); err != nil {
+			t.Fatalf("Unexpected error applying update: %v", err)
+		}
+	}
+	if copied.Text() != shared.Text() {
+		t.Errorf("Updates do not rebuild the document: '%s', expected '%s'", copied.Text(), shared.Text())
+	}
+}
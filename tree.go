@@ -0,0 +1,174 @@
+package fugue
+
+import (
+	"math/rand/v2"
+)
+
+// The linked items are also the nodes of a treap ordered like the list.
+// Every node keeps the total and visible lengths of its subtree,
+// so that the item at a position and the position of an item are found in O(log n).
+
+// subtreeSize returns the sum of the lengths of the items in the subtree
+func (node *linkedItem) subtreeSize() int {
+	if node == nil {
+		return 0
+	}
+	return node.size
+}
+
+// subtreeVisible returns the sum of the lengths of the visible items in the subtree, in every unit
+func (node *linkedItem) subtreeVisible() lengths {
+	if node == nil {
+		return lengths{}
+	}
+	return node.visible
+}
+
+// visibleLength returns the length of the visible content of the item, in every unit
+func (node *linkedItem) visibleLength() lengths {
+	if node.item.deleted {
+		return lengths{}
+	}
+	return node.counts
+}
+
+// pull recomputes the lengths of the subtree from the lengths of its children
+func (node *linkedItem) pull() {
+	node.size = node.left.subtreeSize() + node.length() + node.right.subtreeSize()
+	node.visible = node.left.subtreeVisible().add(node.visibleLength()).add(node.right.subtreeVisible())
+}
+
+// fixUp recomputes the lengths of the subtrees from the node up to the root
+func (list *linkedList) fixUp(node *linkedItem) {
+	for ; node != nil; node = node.parent {
+		node.pull()
+	}
+}
+
+// replaceChild makes new_child take the place of old_child below parent,
+// or at the root of the tree if parent is nil
+func (list *linkedList) replaceChild(parent *linkedItem, old_child *linkedItem, new_child *linkedItem) {
+	if new_child != nil {
+		new_child.parent = parent
+	}
+	switch {
+	case parent == nil:
+		list.root = new_child
+	case parent.left == old_child:
+		parent.left = new_child
+	default:
+		parent.right = new_child
+	}
+}
+
+// rotateUp moves the node above its parent, keeping the order of the tree
+func (list *linkedList) rotateUp(node *linkedItem) {
+	parent := node.parent
+	list.replaceChild(parent.parent, parent, node)
+	if parent.left == node {
+		parent.left = node.right
+		if node.right != nil {
+			node.right.parent = parent
+		}
+		node.right = parent
+	} else {
+		parent.right = node.left
+		if node.left != nil {
+			node.left.parent = parent
+		}
+		node.left = parent
+	}
+	parent.parent = node
+	parent.pull()
+	node.pull()
+}
+
+// treeInsert adds to the tree a node that has already been linked in the list
+func (list *linkedList) treeInsert(node *linkedItem) {
+	node.priority = rand.Uint32()
+	node.pull()
+	// Neighbours in the order of the tree always have a free child between them
+	switch {
+	case node.prev != nil && node.prev.right == nil:
+		node.prev.right = node
+		node.parent = node.prev
+	case node.next != nil:
+		node.next.left = node
+		node.parent = node.next
+	default:
+		list.root = node
+	}
+	list.fixUp(node.parent)
+	for node.parent != nil && node.parent.priority < node.priority {
+		list.rotateUp(node)
+	}
+}
+
+// treeRemove removes the node from the tree
+func (list *linkedList) treeRemove(node *linkedItem) {
+	// Move the node down until it has at most one child
+	for node.left != nil && node.right != nil {
+		if node.left.priority > node.right.priority {
+			list.rotateUp(node.left)
+		} else {
+			list.rotateUp(node.right)
+		}
+	}
+	child := node.left
+	if child == nil {
+		child = node.right
+	}
+	parent := node.parent
+	list.replaceChild(parent, node, child)
+	list.fixUp(parent)
+	node.parent, node.left, node.right = nil, nil, nil
+}
+
+// find finds the first item of the list for which the predicate is true
+//
+// The predicate receives the length in the unit of the visible content before the item and at the end of the item,
+// and must stay true for every item after the first item for which it is true.
+// returns the item and the length of the visible content before it in every unit, or nil if there is no such item
+func (list *linkedList) find(unit Unit, predicate func(before int, end int) bool) (*linkedItem, lengths) {
+	var found *linkedItem = nil
+	var found_before, offset lengths
+	for node := list.root; node != nil; {
+		before := offset.add(node.left.subtreeVisible())
+		end := before.add(node.visibleLength())
+		if predicate(before[unit], end[unit]) {
+			found, found_before = node, before
+			node = node.left
+		} else {
+			offset = end
+			node = node.right
+		}
+	}
+	return found, found_before
+}
+
+// visibleBefore returns the length of the visible content before the item, in every unit
+func (list *linkedList) visibleBefore(node *linkedItem) lengths {
+	before := node.left.subtreeVisible()
+	for ; node.parent != nil; node = node.parent {
+		if node.parent.right == node {
+			before = before.add(node.parent.left.subtreeVisible()).add(node.parent.visibleLength())
+		}
+	}
+	return before
+}
+
+// sizeBefore counts the characters before the item, including deleted ones
+func (list *linkedList) sizeBefore(node *linkedItem) int {
+	before := node.left.subtreeSize()
+	for ; node.parent != nil; node = node.parent {
+		if node.parent.right == node {
+			before += node.parent.left.subtreeSize() + node.parent.length()
+		}
+	}
+	return before
+}
+
+// visibleLength returns the length of the visible content of the list in the unit
+func (list *linkedList) visibleLength(unit Unit) int {
+	return list.root.subtreeVisible()[unit]
+}
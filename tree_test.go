@@ -0,0 +1,89 @@
+package fugue
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// checkTree checks that the treap has the order of the list, valid links, priorities and lengths,
+// and that only the collected items have lost their content
+func checkTree(t *testing.T, list *linkedList) {
+	t.Helper()
+	var nodes []*linkedItem
+	var walk func(node *linkedItem)
+	walk = func(node *linkedItem) {
+		if node == nil {
+			return
+		}
+		for _, child := range []*linkedItem{node.left, node.right} {
+			if child != nil && (child.parent != node || child.priority > node.priority) {
+				t.Fatalf("Invalid child of node %v", node.item.id)
+			}
+		}
+		walk(node.left)
+		nodes = append(nodes, node)
+		walk(node.right)
+		if node.counts != node.item.content.lengths() {
+			t.Fatalf("Invalid cached lengths of node %v: %v", node.item.id, node.counts)
+		}
+		offset := node.item.length
+		for _, f := range node.folded {
+			if f.node != node || f.offset != offset || list.findFolded(f.id) != f || !node.item.collected() {
+				t.Fatalf("Invalid folded tombstone %v of node %v", f.id, node.item.id)
+			}
+			offset += f.length
+		}
+		size, visible := node.size, node.visible
+		node.pull()
+		if size != node.size || visible != node.visible {
+			t.Fatalf("Invalid lengths of node %v: %d/%v, expected %d/%v", node.item.id, size, visible, node.size, node.visible)
+		}
+	}
+	if list.root != nil && list.root.parent != nil {
+		t.Fatalf("The root has a parent")
+	}
+	walk(list.root)
+	i := 0
+	for linked_item := list.head; linked_item != nil; linked_item = linked_item.next {
+		if i >= len(nodes) || nodes[i] != linked_item {
+			t.Fatalf("The tree does not have the order of the list at item %d", i)
+		}
+		// Only the content of collected items is dropped
+		if !linked_item.item.collected() && (linked_item.item.content == "" || linked_item.item.content.length() != linked_item.item.length) {
+			t.Fatalf("Invalid content '%s' of item %v of length %d", linked_item.item.content, linked_item.item.id, linked_item.item.length)
+		}
+		i++
+	}
+	if i != len(nodes) {
+		t.Fatalf("The tree has %d nodes, the list has %d items", len(nodes), i)
+	}
+}
+
+func TestTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1)}
+	for range 2000 {
+		doc := docs[rng.Intn(len(docs))]
+		if rng.Float32() < 0.05 {
+			docs[0].Merge(docs[1])
+			docs[1].Merge(docs[0])
+		} else {
+			randomEdit(t, rng, doc)
+		}
+		checkTree(t, &doc.content)
+		text := []rune(doc.Text())
+		if doc.Len() != len(text) {
+			t.Fatalf("Unexpected length %d, expected %d", doc.Len(), len(text))
+		}
+		// Every position must be found at the same place as with a scan of the list
+		for position := range len(text) {
+			item, item_position, err := doc.findItemAt(position, false)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if item.item.deleted || doc.content.visibleBefore(item)[UnitRune]+item_position != position {
+				t.Fatalf("Position %d found at a wrong place", position)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package fugue
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// stackItem is a group of local changes that can be undone or redone together
+type stackItem struct {
+	inserted deleteSet // ids inserted by the changes, stored as ranges like deleted ids
+	deleted  deleteSet // ids deleted by the changes
+}
+
+// restoration links deleted ids to the ids of the copy inserted to restore them
+type restoration struct {
+	from seqRange // the restored ids
+	to   Id       // the first id of the copy
+}
+
+// UndoManager undoes and redoes the local changes of a document
+//
+// Only the changes made by the client of the document are tracked, remote changes are never undone.
+// Changes made within the capture timeout of each other are grouped and undone together.
+// The state of the manager is guarded by the lock of the document.
+type UndoManager struct {
+	doc             *Doc
+	capture_timeout time.Duration
+	undo_stack      []*stackItem
+	redo_stack      []*stackItem
+	restored        map[Client][]restoration // copies of the restored ids, by client of the restored ids
+	last_change     time.Time                // time of the last local change, used to group changes
+	unobserve       func()
+	now             func() time.Time
+}
+
+// NewUndoManager creates an undo manager tracking the local changes of the document
+//
+// Changes made less than capture_timeout after the previous one are grouped with it
+func NewUndoManager(doc *Doc, capture_timeout time.Duration) *UndoManager {
+	um := &UndoManager{
+		doc:             doc,
+		capture_timeout: capture_timeout,
+		restored:        make(map[Client][]restoration),
+		now:             time.Now,
+	}
+	um.unobserve = doc.observe(&observer{tx_fn: um.afterTransaction})
+	return um
+}
+
+// Close stops tracking the changes of the document
+func (um *UndoManager) Close() {
+	um.unobserve()
+}
+
+// CanUndo checks if there are changes to undo
+func (um *UndoManager) CanUndo() bool {
+	um.doc.mu.RLock()
+	defer um.doc.mu.RUnlock()
+	return len(um.undo_stack) > 0
+}
+
+// CanRedo checks if there are undone changes to redo
+func (um *UndoManager) CanRedo() bool {
+	um.doc.mu.RLock()
+	defer um.doc.mu.RUnlock()
+	return len(um.redo_stack) > 0
+}
+
+// StopCapturing makes the next change start a new group, even within the capture timeout
+func (um *UndoManager) StopCapturing() {
+	um.doc.mu.Lock()
+	defer um.doc.mu.Unlock()
+	um.last_change = time.Time{}
+}
+
+// Clear forgets all the changes to undo and redo
+func (um *UndoManager) Clear() {
+	um.doc.mu.Lock()
+	defer um.doc.mu.Unlock()
+	um.undo_stack = nil
+	um.redo_stack = nil
+}
+
+// Undo reverts the last group of local changes that still has an effect on the document
+//
+// Inserted characters are deleted, and deleted characters are inserted again.
+// returns an error if the document cannot be modified
+func (um *UndoManager) Undo() error {
+	return um.popStack(&um.undo_stack)
+}
+
+// Redo reapplies the last group of changes reverted by Undo
+//
+// returns an error if the document cannot be modified
+func (um *UndoManager) Redo() error {
+	return um.popStack(&um.redo_stack)
+}
+
+// popStack reverts the items of the stack until one of them changes the document
+//
+// The transaction reverting an item has the stack as origin
+func (um *UndoManager) popStack(stack *[]*stackItem) error {
+	for done := false; !done; {
+		err := um.doc.transact(true, func() error {
+			if len(*stack) == 0 {
+				done = true
+				return nil
+			}
+			um.doc.tx.origin = stack
+			item := (*stack)[len(*stack)-1]
+			*stack = (*stack)[:len(*stack)-1]
+			err := um.revert(item)
+			done = um.doc.tx.changed()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error reverting changes: %w", err)
+		}
+	}
+	// The next change must not be grouped with the reverted ones
+	um.StopCapturing()
+	return nil
+}
+
+// revert deletes the characters inserted by the item, and inserts again the characters it deleted
+//
+// The characters are inserted again right after their deleted counterparts,
+// so they are restored at their place even if the document changed since.
+// Characters whose content was collected cannot be restored
+func (um *UndoManager) revert(item *stackItem) error {
+	doc := um.doc
+	inserted := item.inserted.clone()
+	for client, ranges := range item.inserted {
+		for _, r := range ranges {
+			um.addCopies(inserted, client, r)
+		}
+	}
+	for client, ranges := range inserted {
+		for _, r := range ranges {
+			if err := doc.deleteRange(client, r.start, r.length); err != nil {
+				return err
+			}
+		}
+	}
+	type restored struct {
+		after   Id // the last deleted character of the restored content
+		content Content
+		embed   []byte
+	}
+	// The deleted items are found with the id index, and restored in document order
+	seen := make(map[*linkedItem]bool)
+	var deleted []*linkedItem
+	for client, ranges := range item.deleted {
+		for _, r := range ranges {
+			for _, linked_item := range doc.content.itemsIn(client, r) {
+				if !seen[linked_item] && linked_item.item.deleted && !linked_item.item.collected() {
+					seen[linked_item] = true
+					deleted = append(deleted, linked_item)
+				}
+			}
+		}
+	}
+	positions := make(map[*linkedItem]int, len(deleted))
+	for _, linked_item := range deleted {
+		positions[linked_item] = doc.content.sizeBefore(linked_item)
+	}
+	slices.SortFunc(deleted, func(a, b *linkedItem) int { return positions[a] - positions[b] })
+	var restore []restored
+	for _, linked_item := range deleted {
+		id := linked_item.item.id
+		for _, deleted := range item.deleted.intersect(id.client, id.seq, linked_item.item.length) {
+			// Characters both inserted and deleted by the item stay deleted
+			for _, r := range item.inserted.complement(id.client, deleted.start, deleted.length) {
+				_, right := linked_item.item.content.splitAt(int(r.start - id.seq))
+				content, _ := right.splitAt(r.length)
+				restore = append(restore, restored{
+					after:   Id{client: id.client, seq: r.end() - 1},
+					content: content,
+					embed:   linked_item.item.embed,
+				})
+			}
+		}
+	}
+	for _, r := range restore {
+		to := Id{client: doc.client, seq: doc.nextSeq(doc.client)}
+		if err := doc.insertAfterId(doc.client, r.after, r.content, r.embed); err != nil {
+			return err
+		}
+		length := r.content.length()
+		um.restored[r.after.client] = append(um.restored[r.after.client], restoration{
+			from: seqRange{start: r.after.seq - Seq(length-1), length: length},
+			to:   to,
+		})
+	}
+	return nil
+}
+
+// addCopies adds to the set the ids of the copies restoring the given range of ids,
+// and recursively the copies of these copies
+func (um *UndoManager) addCopies(ids deleteSet, client Client, r seqRange) {
+	for _, restored := range um.restored[client] {
+		start := max(r.start, restored.from.start)
+		end := min(r.end(), restored.from.end())
+		if start >= end {
+			continue
+		}
+		copied := seqRange{start: restored.to.seq + (start - restored.from.start), length: int(end - start)}
+		ids.add(restored.to.client, copied.start, copied.length)
+		um.addCopies(ids, restored.to.client, copied)
+	}
+}
+
+// afterTransaction records the local changes of the transaction
+func (um *UndoManager) afterTransaction(tx *transaction) {
+	if !tx.local || (len(tx.deleted) == 0 && len(tx.inserted) == 0) {
+		// Remote changes, formatting marks and entries of the map are not undone
+		return
+	}
+	item := &stackItem{
+		inserted: tx.inserted.clone(),
+		deleted:  tx.deleted.clone(),
+	}
+	switch tx.origin {
+	case &um.undo_stack:
+		um.redo_stack = append(um.redo_stack, item)
+	case &um.redo_stack:
+		um.undo_stack = append(um.undo_stack, item)
+	default:
+		now := um.now()
+		if len(um.undo_stack) > 0 && !um.last_change.IsZero() && now.Sub(um.last_change) < um.capture_timeout {
+			// Group the changes with the previous ones
+			last := um.undo_stack[len(um.undo_stack)-1]
+			last.inserted.merge(item.inserted)
+			last.deleted.merge(item.deleted)
+		} else {
+			um.undo_stack = append(um.undo_stack, item)
+		}
+		um.last_change = now
+		// New changes make the undone changes impossible to redo
+		um.redo_stack = nil
+	}
+}
@@ -0,0 +1,128 @@
+package fugue
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestUndoManager creates an undo manager whose clock only moves when told to
+func newTestUndoManager(doc *Doc) (*UndoManager, *time.Time) {
+	um := NewUndoManager(doc, 500*time.Millisecond)
+	now := time.Unix(0, 0)
+	um.now = func() time.Time { return now }
+	return um, &now
+}
+
+func TestUndoRedo(t *testing.T) {
+	doc := NewDocWithClient(1)
+	um, now := newTestUndoManager(doc)
+	check := func(expected string) {
+		t.Helper()
+		if doc.Text() != expected {
+			t.Errorf("Unexpected content: '%s', expected '%s'", doc.Text(), expected)
+		}
+	}
+	doc.Insert(0, "Hello")
+	*now = now.Add(time.Second)
+	doc.Insert(5, " world")
+	*now = now.Add(time.Second)
+	doc.Delete(0, 6)
+	check("world")
+	um.Undo()
+	check("Hello world")
+	um.Undo()
+	check("Hello")
+	um.Redo()
+	check("Hello world")
+	um.Redo()
+	check("world")
+	if um.CanRedo() {
+		t.Errorf("Unexpected changes to redo")
+	}
+	um.Undo()
+	um.Undo()
+	um.Undo()
+	check("")
+	if um.CanUndo() {
+		t.Errorf("Unexpected changes to undo")
+	}
+	um.Redo()
+	check("Hello")
+	// A new change clears the redo stack
+	doc.Insert(0, "¡")
+	if um.CanRedo() {
+		t.Errorf("Unexpected changes to redo after a new change")
+	}
+	check("¡Hello")
+}
+
+func TestUndoCapture(t *testing.T) {
+	doc := NewDocWithClient(1)
+	um, now := newTestUndoManager(doc)
+	for i, char := range []string{"a", "b", "c"} {
+		doc.Insert(i, char)
+		*now = now.Add(100 * time.Millisecond)
+	}
+	*now = now.Add(time.Second)
+	doc.Insert(3, "d")
+	doc.Delete(0, 1)
+	um.Undo()
+	if doc.Text() != "abc" {
+		t.Errorf("Unexpected content after undoing the second group: '%s'", doc.Text())
+	}
+	um.Undo()
+	if doc.Text() != "" {
+		t.Errorf("Unexpected content after undoing the first group: '%s'", doc.Text())
+	}
+	doc.Insert(0, "x")
+	um.StopCapturing()
+	doc.Insert(1, "y")
+	um.Undo()
+	if doc.Text() != "x" {
+		t.Errorf("Unexpected content after StopCapturing: '%s'", doc.Text())
+	}
+}
+
+func TestUndoOnlyLocalChanges(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	um, _ := newTestUndoManager(doc1)
+	doc1.Insert(0, "abc")
+	syncDocs(t, doc1, doc2)
+	doc2.Insert(1, "XY")
+	doc2.Insert(0, ">")
+	syncDocs(t, doc2, doc1)
+	// The remote changes are kept, and the local characters are deleted by id where they moved
+	um.Undo()
+	if doc1.Text() != ">XY" {
+		t.Errorf("Unexpected content after undoing a local insert: '%s'", doc1.Text())
+	}
+	um.Redo()
+	syncDocs(t, doc1, doc2)
+	if doc2.Text() != ">aXYbc" {
+		t.Errorf("Unexpected content after redo: '%s'", doc2.Text())
+	}
+	// Undoing a local deletion restores the text at its place even after concurrent edits
+	doc1.Delete(3, 2)
+	doc2.Delete(0, 1)
+	doc2.Insert(0, "12")
+	syncDocs(t, doc2, doc1)
+	if doc1.Text() != "12aXc" {
+		t.Fatalf("Unexpected content before undo: '%s'", doc1.Text())
+	}
+	um.Undo()
+	syncDocs(t, doc1, doc2)
+	if doc1.Text() != "12aXYbc" || doc2.Text() != doc1.Text() {
+		t.Errorf("Unexpected content after undoing a local delete: doc1='%s', doc2='%s'", doc1.Text(), doc2.Text())
+	}
+}
+
+func TestUndoClose(t *testing.T) {
+	doc := NewDocWithClient(1)
+	um, _ := newTestUndoManager(doc)
+	um.Close()
+	doc.Insert(0, "abc")
+	if um.CanUndo() {
+		t.Errorf("Unexpected changes tracked after Close")
+	}
+}
@@ -0,0 +1,146 @@
+package fugue
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Unit is the unit in which the positions and lengths of a document are counted
+type Unit int
+
+const (
+	UnitRune    Unit = iota // Unicode code points, the default
+	UnitUTF16               // UTF-16 code units, as used by JavaScript, VS Code and LSP
+	UnitByte                // bytes of the UTF-8 encoding, as used by Go strings
+	unitNewline             // newlines, only counted to find lines, see lines.go
+	unitCount
+)
+
+// ErrInsideCharacter is returned for positions that fall inside a character,
+// such as between the two UTF-16 code units of a surrogate pair
+var ErrInsideCharacter = errors.New("position inside a character")
+
+// lengths is a length counted in every unit
+type lengths [unitCount]int
+
+// add returns the sum of the lengths
+func (l lengths) add(other lengths) lengths {
+	for unit := range l {
+		l[unit] += other[unit]
+	}
+	return l
+}
+
+// sub returns the difference of the lengths
+func (l lengths) sub(other lengths) lengths {
+	for unit := range l {
+		l[unit] -= other[unit]
+	}
+	return l
+}
+
+// runeLength returns the length of the rune in the unit
+func runeLength(r rune, unit Unit) int {
+	switch unit {
+	case UnitUTF16:
+		return utf16.RuneLen(r)
+	case UnitByte:
+		return utf8.RuneLen(r)
+	}
+	return 1
+}
+
+// lengths counts the content in every unit
+func (content Content) lengths() lengths {
+	var counts lengths
+	for _, r := range content {
+		counts[UnitRune]++
+		counts[UnitUTF16] += utf16.RuneLen(r)
+		if r == '\n' {
+			counts[unitNewline]++
+		}
+	}
+	counts[UnitByte] = len(content)
+	return counts
+}
+
+// runeOffset converts an offset in the unit into an offset in runes in the content
+//
+// returns false if the offset falls inside a character
+func (content Content) runeOffset(offset int, unit Unit) (int, bool) {
+	runes, units := 0, 0
+	for _, r := range content {
+		if units >= offset {
+			break
+		}
+		units += runeLength(r, unit)
+		runes++
+	}
+	return runes, units == offset
+}
+
+// Unit returns the unit in which the positions and lengths of the document are counted
+func (doc *Doc) Unit() Unit {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.unit
+}
+
+// SetUnit changes the unit in which the positions and lengths of the document are counted,
+// for Insert, Delete, Len, relative positions and the deltas of the events
+//
+// returns an error if the unit is not UnitRune, UnitUTF16 or UnitByte
+func (doc *Doc) SetUnit(unit Unit) error {
+	if unit != UnitRune && unit != UnitUTF16 && unit != UnitByte {
+		return fmt.Errorf("unknown unit %d", unit)
+	}
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	doc.unit = unit
+	return nil
+}
+
+// toRunes converts a visible position in the unit of the document into a position in runes
+//
+// returns an error if the position is out of bounds or inside a character
+func (doc *Doc) toRunes(position int) (int, error) {
+	total := doc.content.visibleLength(doc.unit)
+	if position < 0 || position > total {
+		return -1, &OutOfBoundErr{position - total}
+	}
+	if doc.unit == UnitRune {
+		return position, nil
+	}
+	if position == total {
+		return doc.content.visibleLength(UnitRune), nil
+	}
+	item, before := doc.content.find(doc.unit, func(before int, end int) bool { return end > position })
+	offset, ok := item.item.content.runeOffset(position-before[doc.unit], doc.unit)
+	if !ok {
+		return -1, ErrInsideCharacter
+	}
+	return before[UnitRune] + offset, nil
+}
+
+// fromRunes converts a visible position in runes into a position in the unit of the document
+func (doc *Doc) fromRunes(position int) int {
+	if doc.unit == UnitRune {
+		return position
+	}
+	item, before := doc.content.find(UnitRune, func(before int, end int) bool { return end > position })
+	if item == nil {
+		return doc.content.visibleLength(doc.unit)
+	}
+	prefix, _ := item.item.content.splitAt(position - before[UnitRune])
+	return before[doc.unit] + prefix.lengths()[doc.unit]
+}
+
+// unitLength returns the length of the content in the unit of the document
+func (doc *Doc) unitLength(content Content) int {
+	if doc.unit == UnitRune {
+		return content.length()
+	}
+	return content.lengths()[doc.unit]
+}
@@ -0,0 +1,80 @@
+package fugue
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnits(t *testing.T) {
+	doc := NewDocWithClient(1)
+	doc.Insert(0, "a😀é!")
+	expected := map[Unit]int{UnitRune: 4, UnitUTF16: 5, UnitByte: 8}
+	for unit, length := range expected {
+		if err := doc.SetUnit(unit); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if doc.Len() != length {
+			t.Errorf("Unexpected length in unit %d: %d, expected %d", unit, doc.Len(), length)
+		}
+	}
+	// Only the public units can be selected
+	selected := doc.Unit()
+	for _, unit := range []Unit{unitNewline, unitCount, -1} {
+		if err := doc.SetUnit(unit); err == nil || doc.Unit() != selected {
+			t.Errorf("Unexpected unit %d accepted", unit)
+		}
+	}
+	// Positions after the emoji are shifted in UTF-16 and bytes
+	doc.SetUnit(UnitUTF16)
+	if err := doc.Insert(3, "b"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	doc.SetUnit(UnitByte)
+	if err := doc.Insert(8, "c"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc.Text() != "a😀béc!" {
+		t.Fatalf("Unexpected content: '%s'", doc.Text())
+	}
+	// Positions inside a character are rejected
+	doc.SetUnit(UnitUTF16)
+	if err := doc.Insert(2, "x"); !errors.Is(err, ErrInsideCharacter) {
+		t.Errorf("Unexpected error inside a surrogate pair: %v", err)
+	}
+	doc.SetUnit(UnitByte)
+	if err := doc.Delete(0, 2); !errors.Is(err, ErrInsideCharacter) {
+		t.Errorf("Unexpected error inside a multi-byte character: %v", err)
+	}
+	var out_of_bound *OutOfBoundErr
+	if err := doc.Insert(11, "x"); !errors.As(err, &out_of_bound) {
+		t.Errorf("Unexpected error out of bounds: %v", err)
+	}
+	// Deltas and relative positions are counted in the unit
+	var events []Event
+	doc.Observe(func(event Event) { events = append(events, event) })
+	doc.SetUnit(UnitUTF16)
+	rp, err := doc.RelativePositionAt(5, AssocRight)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := doc.Delete(1, 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc.Text() != "abéc!" {
+		t.Fatalf("Unexpected content: '%s'", doc.Text())
+	}
+	if position, _ := doc.AbsolutePosition(rp); position != 3 {
+		t.Errorf("Unexpected position %d, expected 3", position)
+	}
+	expected_delta := []DeltaOp{{Retain: 1}, {Delete: 2}}
+	if len(events) != 1 || !equalDeltas(events[0].Delta, expected_delta) {
+		t.Errorf("Unexpected events: %v, expected %v", events, expected_delta)
+	}
+	doc.SetUnit(UnitByte)
+	if err := doc.Delete(2, 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc.Text() != "abc!" || !equalDeltas(events[1].Delta, []DeltaOp{{Retain: 2}, {Delete: 2}}) {
+		t.Errorf("Unexpected state: '%s' %v", doc.Text(), events[1].Delta)
+	}
+}
@@ -0,0 +1,568 @@
+package fugue
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"unicode/utf8"
+)
+
+// update is a set of changes exchanged between documents
+type update struct {
+	items     []Item       // items in document order, without their deleted flag
+	deleted   deleteSet    // ids of every deleted item
+	deletions []deletion   // clients that deleted the ids of the delete set, sorted by client and seq, see deleteset.go
+	marks     []mark       // formatting marks, see marks.go
+	entries   []entry      // entries of the map, sorted by client and seq, see map.go
+	values    []encodedRun // values of the elements of the items, see sequence.go
+}
+
+// EncodeStateVector encodes the version of the document so that a peer can
+// compute the changes this document is missing with EncodeDiff
+func (doc *Doc) EncodeStateVector() []byte {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return encodeVersion(doc.version)
+}
+
+// EncodeDiff encodes the changes of the document that are not in the given state vector
+//
+// An empty state vector encodes the whole document.
+// returns an error if the state vector is malformed,
+// or ErrContainerRoot if the document is a root of a container, whose changes are encoded by the container
+func (doc *Doc) EncodeDiff(state_vector []byte) ([]byte, error) {
+	if doc.container != nil {
+		return nil, ErrContainerRoot
+	}
+	version, err := decodeVersion(state_vector)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding state vector: %w", err)
+	}
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	upd := doc.diff(version)
+	if err := doc.encodeValues(upd); err != nil {
+		return nil, err
+	}
+	return encodeUpdate(upd), nil
+}
+
+// EncodeState encodes the whole document as an update, which can be persisted
+// and loaded back by applying it to an empty document
+//
+// returns nil if the document is a root of a container, whose state is encoded by the container,
+// as the seqs of the root alone cannot be loaded in another document
+func (doc *Doc) EncodeState() []byte {
+	if doc.container != nil {
+		return nil
+	}
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	upd := doc.diff(make(Version))
+	doc.encodeValues(upd)
+	return encodeUpdate(upd)
+}
+
+// ApplyUpdate applies an update produced by EncodeDiff on another document
+//
+// Applying the same update several times has no further effect.
+// If the update contains edits made with the client of this document by another replica,
+// the document continues with a new random client so that the histories cannot fork.
+// The update is applied all-or-nothing: if it cannot be applied, the document is left unchanged.
+// returns ErrInvalidEncoding or ErrMalformedItem if the update is malformed,
+// ErrCausalityViolation if it depends on changes that are not in the document,
+// ErrClientConflict if it has different edits under ids already in the document,
+// or ErrContainerRoot if the document is a root of a container, whose updates are applied by the container
+func (doc *Doc) ApplyUpdate(data []byte) error {
+	if doc.container != nil {
+		return ErrContainerRoot
+	}
+	upd, err := decodeUpdate(data)
+	if err != nil {
+		return fmt.Errorf("error decoding update: %w", err)
+	}
+	return doc.transact(false, func() error {
+		return doc.applyUpdate(upd)
+	})
+}
+
+// diff returns the changes of the document that are not in the given version
+//
+// The delete set is not versioned, so every deleted item is part of the diff,
+// while the deletions telling who deleted them are only sent if they are not in the version
+func (doc *Doc) diff(version Version) *update {
+	upd := &update{deleted: doc.deleted.clone()}
+	for _, d := range append(doc.sortedDeletions(), doc.pending_deletions...) {
+		if !isInVersion(&d.id, &version) {
+			// The GC prunes the ids of the deletions of the document
+			upd.deletions = append(upd.deletions, deletion{id: d.id, deleted: d.deleted.clone()})
+		}
+	}
+	slices.SortFunc(upd.deletions, compareDeletionIds)
+	for _, m := range append(doc.sortedMarks(), doc.pending_marks...) {
+		if !isInVersion(&m.id, &version) {
+			upd.marks = append(upd.marks, m)
+		}
+	}
+	slices.SortFunc(upd.marks, compareMarks)
+	for _, e := range append(doc.sortedEntries(), doc.pending_entries...) {
+		if !isInVersion(&e.id, &version) {
+			upd.entries = append(upd.entries, e)
+		}
+	}
+	slices.SortFunc(upd.entries, compareEntryIds)
+	for linked_item := doc.content.head; linked_item != nil; linked_item = linked_item.next {
+		for _, item := range linked_item.items() {
+			if cropped, err := cropOutVersion(item, &version); err == nil {
+				cropped.deleted = false
+				upd.items = append(upd.items, cropped)
+			}
+		}
+	}
+	// Pending items are passed on, so that they are not lost when the document is persisted
+	for _, item := range doc.pending {
+		if cropped, err := cropOutVersion(item, &version); err == nil {
+			upd.items = append(upd.items, cropped)
+		}
+	}
+	return upd
+}
+
+// Missing returns the last seq of every client that pending items are waiting for
+//
+// The state vector of a document containing these seqs covers everything the pending items depend on,
+// so the missing changes can be requested from a peer that has them.
+func (doc *Doc) Missing() Version {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.missing()
+}
+
+// EncodeMissing encodes the seqs returned by Missing as a state vector
+func (doc *Doc) EncodeMissing() []byte {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return encodeVersion(doc.missing())
+}
+
+// missing finds the ids the pending items, entries, marks and deletions depend on that are neither in the document nor pending
+func (doc *Doc) missing() Version {
+	// Pending entries, marks and deletions only depend on the previous seq of their client
+	var changes []Id
+	for _, e := range doc.pending_entries {
+		changes = append(changes, e.id)
+	}
+	for _, m := range doc.pending_marks {
+		changes = append(changes, m.id)
+	}
+	for _, d := range doc.pending_deletions {
+		changes = append(changes, d.id)
+	}
+	pending := make(deleteSet)
+	for _, item := range doc.pending {
+		pending.add(item.id.client, item.id.seq, item.length)
+	}
+	for _, id := range changes {
+		pending.add(id.client, id.seq, 1)
+	}
+	var dependencies []*Id
+	for _, item := range doc.pending {
+		dependencies = append(dependencies, item.origin_left, item.origin_right)
+		if item.id.seq > 0 {
+			dependencies = append(dependencies, &Id{client: item.id.client, seq: item.id.seq - 1})
+		}
+	}
+	for _, id := range changes {
+		if id.seq > 0 {
+			dependencies = append(dependencies, &Id{client: id.client, seq: id.seq - 1})
+		}
+	}
+	missing := make(Version)
+	for _, id := range dependencies {
+		if isInVersion(id, &doc.version) || pending.contains(*id) {
+			continue
+		}
+		if seq, ok := missing[id.client]; !ok || seq < id.seq {
+			missing[id.client] = id.seq
+		}
+	}
+	return missing
+}
+
+// applyUpdate integrates the missing items, entries, marks and deletions of the update, then applies its delete set
+//
+// Items, entries, marks and deletions whose dependencies are missing are kept pending, and retried with every later update.
+// Deleted ids of missing items are kept in the delete set until the items are integrated.
+// The update is validated before the document is modified, so it is applied all-or-nothing.
+// returns ErrMalformedItem, ErrClientConflict or ErrCausalityViolation if the update cannot be applied,
+// or ErrContainerRoot if the document is a root of a container, whose updates are applied by the container
+func (doc *Doc) applyUpdate(upd *update) error {
+	if doc.container != nil {
+		return ErrContainerRoot
+	}
+	plan, err := doc.plan(upd)
+	if err != nil {
+		return err
+	}
+	own_seq, had_own := doc.version[doc.client]
+	if err := doc.integratePlan(plan); err != nil {
+		return err
+	}
+	for {
+		progressed, err := doc.integratePending()
+		if err != nil {
+			return err
+		}
+		if !progressed {
+			break
+		}
+	}
+	if seq, ok := doc.version[doc.client]; ok && (!had_own || seq != own_seq) {
+		// Another replica made edits with our client, later local edits could reuse their seqs
+		doc.client = RandomClient()
+	}
+	return doc.applyDeletes(upd.deleted)
+}
+
+// plannedUpdate is an update validated against a document, ready to be integrated
+type plannedUpdate struct {
+	items     []Item     // missing items, in the order they can be integrated
+	pending   []Item     // items whose dependencies are still missing
+	entries   []entry    // entries that are not in the document, including the pending ones
+	marks     []mark     // marks that are not in the document, including the pending ones
+	deletions []deletion // deletions that are not in the document, including the pending ones
+	store     func()     // stores the decoded values of the elements of the items, nil for a text
+}
+
+// plan validates the update and plans the integration of its items, entries, marks and deletions, without modifying the document
+//
+// returns ErrMalformedItem, ErrClientConflict or ErrCausalityViolation if the update cannot be applied,
+// or ErrInvalidEncoding if the values of its elements cannot be decoded
+func (doc *Doc) plan(upd *update) (*plannedUpdate, error) {
+	items, pending, err := doc.planUpdate(upd)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := doc.planEntries(upd.entries)
+	if err != nil {
+		return nil, err
+	}
+	marks, err := doc.planMarks(upd.marks)
+	if err != nil {
+		return nil, err
+	}
+	deletions, err := doc.planDeletions(upd.deletions)
+	if err != nil {
+		return nil, err
+	}
+	var store func()
+	if doc.elements != nil {
+		if store, err = doc.elements.decode(upd.values); err != nil {
+			return nil, err
+		}
+	}
+	return &plannedUpdate{items: items, pending: pending, entries: entries, marks: marks, deletions: deletions, store: store}, nil
+}
+
+// integratePlan integrates the planned items and keeps the other items, the entries, the marks and the deletions pending
+//
+// The values of the items are stored first, including the values of the pending items
+func (doc *Doc) integratePlan(plan *plannedUpdate) error {
+	if plan.store != nil {
+		plan.store()
+	}
+	doc.pending = plan.pending
+	doc.pending_entries = plan.entries
+	doc.pending_marks = plan.marks
+	doc.pending_deletions = plan.deletions
+	for _, item := range plan.items {
+		doc.integrateChangesBefore(item)
+		if err := doc.integrate(item); err != nil {
+			return fmt.Errorf("error integrating item: %w", err)
+		}
+	}
+	return nil
+}
+
+// integratePending integrates the pending entries, marks, deletions and items whose dependencies are now in the version
+//
+// The seqs of the entries, marks and deletions, or of the items of the other roots of a container,
+// may be the ones the pending items were waiting for.
+// returns true if something was integrated, in which case more pending changes may be integrable
+func (doc *Doc) integratePending() (bool, error) {
+	progressed := doc.integrateEntries()
+	progressed = doc.integrateMarks() || progressed
+	progressed = doc.integrateDeletions() || progressed
+	if len(doc.pending) == 0 {
+		return progressed, nil
+	}
+	items, pending, err := doc.planUpdate(&update{})
+	if err != nil {
+		return false, err
+	}
+	doc.pending = pending
+	for _, item := range items {
+		doc.integrateChangesBefore(item)
+		if err := doc.integrate(item); err != nil {
+			return false, fmt.Errorf("error integrating item: %w", err)
+		}
+	}
+	return progressed || len(items) > 0, nil
+}
+
+// integrateChangesBefore integrates the pending entries, marks and deletions of the client of the item
+// taking the seqs right before it, which planUpdate counted on
+func (doc *Doc) integrateChangesBefore(item Item) {
+	for doc.nextSeq(item.id.client) < item.id.seq {
+		if !doc.integrateNextChange(item.id.client) {
+			return
+		}
+	}
+}
+
+// integrateNextChange integrates the pending entry, mark or deletion taking the next seq of the client
+//
+// The change stays in its pending list until the next integratePending drops it, since its seq is in the version.
+// returns false if the next seq of the client is not a pending entry, mark or deletion
+func (doc *Doc) integrateNextChange(client Client) bool {
+	next := Id{client: client, seq: doc.nextSeq(client)}
+	compare := func(id Id) int { return cmp.Or(cmp.Compare(id.client, next.client), cmp.Compare(id.seq, next.seq)) }
+	if i, found := slices.BinarySearchFunc(doc.pending_entries, next, func(e entry, _ Id) int { return compare(e.id) }); found {
+		doc.integrateEntry(doc.pending_entries[i])
+		return true
+	}
+	if i, found := slices.BinarySearchFunc(doc.pending_marks, next, func(m mark, _ Id) int { return compare(m.id) }); found {
+		doc.integrateMark(doc.pending_marks[i])
+		return true
+	}
+	if i, found := slices.BinarySearchFunc(doc.pending_deletions, next, func(d deletion, _ Id) int { return compare(d.id) }); found {
+		doc.integrateDeletion(doc.pending_deletions[i])
+		return true
+	}
+	return false
+}
+
+// skipChanges advances the version of the client past the changes that follow it
+func skipChanges(version Version, changes deleteSet, client Client) {
+	next := Seq(0)
+	if seq, ok := version[client]; ok {
+		next = seq + 1
+	}
+	for ; changes.contains(Id{client: client, seq: next}); next++ {
+		version[client] = next
+	}
+}
+
+// planUpdate validates the items of the update and orders the missing ones so that
+// every item can be integrated after the previous ones, together with the pending items
+//
+// Items are planned client by client in seq order. When an item depends on an item
+// of another client, the items of that client are planned first.
+// returns the missing items, cropped to the parts that are not in the document,
+// the items whose dependencies are still missing, or an error if some items are malformed
+func (doc *Doc) planUpdate(upd *update) ([]Item, []Item, error) {
+	queues := make(map[Client][]Item)
+	change_ids := make(deleteSet)
+	for _, e := range upd.entries {
+		change_ids.add(e.id.client, e.id.seq, 1)
+	}
+	for _, m := range upd.marks {
+		change_ids.add(m.id.client, m.id.seq, 1)
+	}
+	for _, d := range upd.deletions {
+		change_ids.add(d.id.client, d.id.seq, 1)
+	}
+	// The pending entries, marks and deletions following the version of their client
+	// are integrated right before the items after them, see integrateChangesBefore
+	pending_changes := change_ids.clone()
+	for _, e := range doc.pending_entries {
+		pending_changes.add(e.id.client, e.id.seq, 1)
+	}
+	for _, m := range doc.pending_marks {
+		pending_changes.add(m.id.client, m.id.seq, 1)
+	}
+	for _, d := range doc.pending_deletions {
+		pending_changes.add(d.id.client, d.id.seq, 1)
+	}
+	for _, item := range upd.items {
+		if err := validateItem(item); err != nil {
+			return nil, nil, err
+		}
+		if err := doc.checkOrigins(item, change_ids); err != nil {
+			return nil, nil, err
+		}
+		if err := doc.checkHistory(item); err != nil {
+			return nil, nil, err
+		}
+		if err := checkCollected(item, upd.deleted, doc.deleted); err != nil {
+			return nil, nil, err
+		}
+		queues[item.id.client] = append(queues[item.id.client], item)
+	}
+	for _, item := range doc.pending {
+		queues[item.id.client] = append(queues[item.id.client], item)
+	}
+	for client, queue := range queues {
+		slices.SortStableFunc(queue, func(a, b Item) int { return int(a.id.seq - b.id.seq) })
+		// The same items can be received several times, for instance when they are pending
+		deduplicated := queue[:0]
+		var end Seq = 0
+		for _, item := range queue {
+			if len(deduplicated) > 0 && item.id.seq < end {
+				last := deduplicated[len(deduplicated)-1]
+				length := int(min(end, item.id.seq+Seq(item.length)) - item.id.seq)
+				if !sameHistory(last, item, item.id.seq, length) {
+					return nil, nil, fmt.Errorf("%w: client %d differs at seq %d", ErrClientConflict, client, item.id.seq)
+				}
+				var err error
+				if item, err = cropOutVersion(item, &Version{client: end - 1}); err != nil {
+					// The item is contained in the previous one
+					continue
+				}
+			}
+			deduplicated = append(deduplicated, item)
+			end = item.id.seq + Seq(item.length)
+		}
+		queues[client] = deduplicated
+	}
+	type frame struct {
+		client     Client
+		progressed bool // whether an item of the client has been planned since it was pushed
+	}
+	// Version of the document once the planned items are integrated
+	version := maps.Clone(doc.version)
+	for client := range pending_changes {
+		skipChanges(version, pending_changes, client)
+	}
+	var planned []Item
+	blocked := make(map[Client]bool)
+	for _, client := range sortedClients(queues) {
+		stack := []frame{{client: client}}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			queue := queues[top.client]
+			if len(queue) == 0 || blocked[top.client] {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			item, err := cropOutVersion(queue[0], &version)
+			if err != nil {
+				// The item is already in the document
+				queues[top.client] = queue[1:]
+				continue
+			}
+			if dependency, missing := missingDependency(item, &version); missing {
+				on_stack := slices.ContainsFunc(stack, func(f frame) bool { return f.client == dependency })
+				switch {
+				case on_stack && top.progressed:
+					// Go back to the client we depend on, it may be able to progress now
+					stack = stack[:len(stack)-1]
+				case dependency != top.client && !on_stack && !blocked[dependency] && len(queues[dependency]) > 0:
+					// Plan the items of the other client first
+					stack = append(stack, frame{client: dependency})
+				default:
+					// The dependency is not in the update, or depends on this client,
+					// so no later item of the client can be integrated
+					blocked[top.client] = true
+				}
+				continue
+			}
+			planned = append(planned, item)
+			version[item.id.client] = item.id.seq + Seq(item.length-1)
+			skipChanges(version, pending_changes, item.id.client)
+			queues[top.client] = queue[1:]
+			top.progressed = true
+		}
+	}
+	var pending []Item
+	for _, client := range sortedClients(queues) {
+		pending = append(pending, queues[client]...)
+	}
+	return planned, pending, nil
+}
+
+// validateItem checks that the fields of the item are consistent
+//
+// returns ErrMalformedItem if the content is not valid UTF-8 of the length of the item,
+// unless it was collected, or if the ids of the item are out of range,
+// and ErrCausalityViolation if the item depends on itself or on a later item of its client
+func validateItem(item Item) error {
+	for _, origin := range []*Id{item.origin_left, item.origin_right} {
+		if origin != nil && origin.client == item.id.client && origin.seq >= item.id.seq {
+			return fmt.Errorf("%w: item %d:%d depends on seq %d of its client", ErrCausalityViolation, item.id.client, item.id.seq, origin.seq)
+		}
+	}
+	switch {
+	case item.length <= 0 || !utf8.ValidString(string(item.content)):
+		return fmt.Errorf("%w: content of item %d:%d must be non-empty UTF-8", ErrMalformedItem, item.id.client, item.id.seq)
+	case !item.collected() && item.length != item.content.length():
+		return fmt.Errorf("%w: item %d:%d has length %d for %d characters", ErrMalformedItem, item.id.client, item.id.seq, item.length, item.content.length())
+	case !validEmbed(item):
+		return fmt.Errorf("%w: embed %d:%d must have a payload and a single character", ErrMalformedItem, item.id.client, item.id.seq)
+	case item.id.seq < 0 || item.id.seq+Seq(item.length-1) > maxSeq:
+		return fmt.Errorf("%w: item %d:%d of length %d out of range", ErrMalformedItem, item.id.client, item.id.seq, item.length)
+	}
+	return nil
+}
+
+// checkHistory checks that the part of the item already in the document is identical to the document
+//
+// Two replicas using the same client create different items with the same ids,
+// which would silently corrupt every document receiving both.
+// returns ErrClientConflict if the item differs from the document
+func (doc *Doc) checkHistory(item Item) error {
+	known, ok := doc.version[item.id.client]
+	if !ok || known < item.id.seq {
+		return nil
+	}
+	end := min(item.id.seq+Seq(item.length), known+1)
+	for seq := item.id.seq; seq < end; {
+		ours, found := doc.content.itemOf(Id{client: item.id.client, seq: seq})
+		if _, ok := doc.entries[Id{client: item.id.client, seq: seq}]; ok {
+			return fmt.Errorf("%w: client %d has an entry at seq %d", ErrClientConflict, item.id.client, seq)
+		}
+		if _, ok := doc.marks[Id{client: item.id.client, seq: seq}]; ok {
+			return fmt.Errorf("%w: client %d has a mark at seq %d", ErrClientConflict, item.id.client, seq)
+		}
+		if _, ok := doc.deletions[Id{client: item.id.client, seq: seq}]; ok {
+			return fmt.Errorf("%w: client %d has a deletion at seq %d", ErrClientConflict, item.id.client, seq)
+		}
+		if !found {
+			// The seq is used by another root of the container
+			return fmt.Errorf("%w: client %d has an item of another root at seq %d", ErrClientConflict, item.id.client, seq)
+		}
+		length := int(min(end, ours.id.seq+Seq(ours.length)) - seq)
+		if !sameHistory(ours, item, seq, length) {
+			return fmt.Errorf("%w: client %d differs at seq %d", ErrClientConflict, item.id.client, seq)
+		}
+		seq += Seq(length)
+	}
+	return nil
+}
+
+// sameHistory checks that two items of the same client have the same characters, embeds and origins
+// for the length ids starting at seq, which must be in both items
+//
+// The characters of collected items are unknown, so only their origins are compared
+func sameHistory(ours Item, theirs Item, seq Seq, length int) bool {
+	// Characters after the first one of an item have the previous character as origin_left
+	our_left, their_left := ours.origin_left, theirs.origin_left
+	if seq > ours.id.seq {
+		our_left = &Id{client: ours.id.client, seq: seq - 1}
+	}
+	if seq > theirs.id.seq {
+		their_left = &Id{client: theirs.id.client, seq: seq - 1}
+	}
+	return our_left.equals(their_left) && ours.origin_right.equals(theirs.origin_right) &&
+		(ours.collected() || theirs.collected() ||
+			contentRange(ours, seq, length) == contentRange(theirs, seq, length) && bytes.Equal(ours.embed, theirs.embed))
+}
+
+// contentRange returns the content of the item for the length characters starting at seq
+func contentRange(item Item, seq Seq, length int) Content {
+	_, right := item.content.splitAt(int(seq - item.id.seq))
+	content, _ := right.splitAt(length)
+	return content
+}
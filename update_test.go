@@ -0,0 +1,311 @@
+package fugue
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// syncDocs sends to doc2 the changes of doc1 that doc2 is missing, over bytes
+func syncDocs(t *testing.T, doc1 *Doc, doc2 *Doc) {
+	t.Helper()
+	diff, err := doc1.EncodeDiff(doc2.EncodeStateVector())
+	if err != nil {
+		t.Fatalf("Unexpected error encoding diff: %v", err)
+	}
+	if err := doc2.ApplyUpdate(diff); err != nil {
+		t.Fatalf("Unexpected error applying update: %v", err)
+	}
+}
+
+// fuzzChars are the characters inserted by the fuzzers, including multi-byte and multi-unit ones
+var fuzzChars = []rune("abcdefghijklmnopqrstuvwxyz零一二三四五六七八九十😀")
+
+// randomEdit makes the same random edit on every document, as a user typing in the first one would,
+// inserting a character or deleting up to 3 characters
+//
+// Positions are picked between characters, and counted in the unit of the first document
+func randomEdit(t *testing.T, rng *rand.Rand, docs ...*Doc) {
+	t.Helper()
+	runes := []rune(docs[0].Text())
+	position, length := randomChange(rng, len(runes))
+	start := docs[0].unitLength(Content(runes[:position]))
+	end := docs[0].unitLength(Content(runes[:position+length]))
+	text := string(fuzzChars[rng.Intn(len(fuzzChars))])
+	for _, doc := range docs {
+		var err error
+		if length == 0 {
+			err = doc.Insert(start, text)
+		} else {
+			err = doc.Delete(start, end-start)
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error editing at %d: %v", start, err)
+		}
+	}
+}
+
+// randomChange picks a random change of a document or a sequence of the given length
+//
+// returns the position of the change and the length of the deletion, 0 for an insertion
+func randomChange(rng *rand.Rand, length int) (int, int) {
+	if length == 0 || rng.Float32() < 0.6 {
+		return rng.Intn(length + 1), 0
+	}
+	position := rng.Intn(length)
+	return position, 1 + rng.Intn(min(length-position, 3))
+}
+
+func TestDeltaSync(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "Hello")
+	syncDocs(t, doc1, doc2)
+	doc2.Insert(5, " World")
+	doc1.Insert(0, "¡")
+	doc1.Delete(1, 1)
+	syncDocs(t, doc2, doc1)
+	syncDocs(t, doc1, doc2)
+	if doc1.Text() != "¡ello World" || doc2.Text() != doc1.Text() {
+		t.Errorf("Unexpected content after sync: doc1='%s', doc2='%s'", doc1.Text(), doc2.Text())
+	}
+	// Applying the same update twice has no further effect
+	update, _ := doc1.EncodeDiff(nil)
+	if err := doc2.ApplyUpdate(update); err != nil {
+		t.Errorf("Unexpected error applying update twice: %v", err)
+	}
+	if doc2.Text() != doc1.Text() {
+		t.Errorf("Unexpected content after applying twice: '%s'", doc2.Text())
+	}
+	// A diff against an up to date state vector only carries deletions
+	diff, _ := doc1.EncodeDiff(doc2.EncodeStateVector())
+	upd, err := decodeUpdate(diff)
+	if err != nil || len(upd.items) != 0 {
+		t.Errorf("Unexpected diff against an up to date state vector: %v %v", upd, err)
+	}
+}
+
+func TestDeltaSyncPartialItem(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "零一")
+	syncDocs(t, doc1, doc2)
+	// The next insert is merged with the previous item in doc1, so the diff must crop it
+	doc1.Insert(2, "二三")
+	syncDocs(t, doc1, doc2)
+	if doc2.Text() != "零一二三" {
+		t.Errorf("Unexpected content after partial sync: '%s'", doc2.Text())
+	}
+}
+
+func TestApplyUpdateMalformed(t *testing.T) {
+	doc := NewDocWithClient(1)
+	doc.Insert(0, "abc")
+	update, _ := doc.EncodeDiff(nil)
+	for i := range len(update) {
+		if err := NewDocWithClient(2).ApplyUpdate(update[:i]); err == nil {
+			t.Errorf("Expected an error for an update truncated at %d", i)
+		}
+	}
+	if _, err := doc.EncodeDiff([]byte{0xff}); err == nil {
+		t.Errorf("Expected an error for a malformed state vector")
+	}
+}
+
+func TestApplyUpdateAtomic(t *testing.T) {
+	doc := NewDocWithClient(1)
+	doc.Insert(0, "abc")
+	valid := Item{id: Id{client: 4}, content: "x", length: 1}
+	// Nothing of an update is applied if one of its items is invalid
+	malformed := []*update{
+		{items: []Item{valid, {id: Id{client: 5}, content: "ab", length: 1}}},
+		{items: []Item{valid, {id: Id{client: 5}, content: "\xff", length: 1}}},
+		{items: []Item{valid, {id: Id{client: 5}, content: "", length: 0}}},
+	}
+	for _, upd := range malformed {
+		upd.deleted = deleteSet{1: {{start: 0, length: 1}}}
+		if err := doc.applyUpdate(upd); !errors.Is(err, ErrMalformedItem) {
+			t.Errorf("Unexpected error for a malformed item: %v", err)
+		}
+	}
+	self_dependent := Item{id: Id{client: 5, seq: 1}, origin_left: &Id{client: 5, seq: 1}, content: "y", length: 1}
+	if err := doc.applyUpdate(&update{items: []Item{valid, self_dependent}}); !errors.Is(err, ErrCausalityViolation) {
+		t.Errorf("Unexpected error for an item depending on itself: %v", err)
+	}
+	// Overlapping items of the same client must agree
+	overlapping := []Item{valid, {id: Id{client: 4}, content: "xy", length: 2}}
+	if err := doc.applyUpdate(&update{items: overlapping}); err != nil {
+		t.Errorf("Unexpected error for consistent items: %v", err)
+	}
+	overlapping = []Item{{id: Id{client: 6}, content: "ab", length: 2}, {id: Id{client: 6, seq: 1}, content: "b", length: 1}}
+	if err := doc.applyUpdate(&update{items: overlapping}); !errors.Is(err, ErrClientConflict) {
+		t.Errorf("Unexpected error for inconsistent items: %v", err)
+	}
+	if doc.Text() != "xyabc" && doc.Text() != "abcxy" {
+		t.Errorf("Unexpected content after invalid updates: '%s'", doc.Text())
+	}
+}
+
+func TestPendingUpdates(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(2)
+	doc1.Insert(0, "abc")
+	first := doc1.EncodeState()
+	doc1.Insert(3, "def")
+	second, _ := doc1.EncodeDiff(encodeVersion(Version{1: 2}))
+	doc1.Insert(6, "ghi")
+	doc1.Delete(0, 1)
+	third, _ := doc1.EncodeDiff(encodeVersion(Version{1: 5}))
+	// The last changes arrive first and wait for the ones they depend on
+	if err := doc2.ApplyUpdate(third); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if doc2.Text() != "" || len(doc2.pending) != 1 {
+		t.Errorf("Unexpected state with pending items: '%s' %v", doc2.Text(), doc2.pending)
+	}
+	if missing := doc2.Missing(); len(missing) != 1 || missing[1] != 5 {
+		t.Errorf("Unexpected missing seqs: %v", missing)
+	}
+	// Pending items survive persistence
+	doc3 := NewDocWithClient(3)
+	if err := doc3.ApplyUpdate(doc2.EncodeState()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := json.Marshal(doc2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	doc4 := NewDoc()
+	if err := json.Unmarshal(data, doc4); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, doc := range []*Doc{doc2, doc3, doc4} {
+		if err := doc.ApplyUpdate(first); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// The deletion of a received item is applied at once
+		if doc.Text() != "bc" || doc.Missing()[1] != 5 {
+			t.Errorf("Unexpected state with pending items: '%s' %v", doc.Text(), doc.Missing())
+		}
+		if err := doc.ApplyUpdate(second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if doc.Text() != "bcdefghi" || len(doc.pending) != 0 || len(doc.Missing()) != 0 {
+			t.Errorf("Unexpected state after receiving the missing items: '%s' %v", doc.Text(), doc.pending)
+		}
+	}
+}
+
+func TestDeltaSyncFuzzer(t *testing.T) {
+	const trials int64 = 200
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		for range 200 {
+			randomEdit(t, rng, docs[rng.Intn(len(docs))])
+			if rng.Float32() < 0.1 {
+				// Sync two random documents in one direction
+				syncDocs(t, docs[rng.Intn(len(docs))], docs[rng.Intn(len(docs))])
+			}
+		}
+		for _, from := range docs {
+			for _, to := range docs {
+				syncDocs(t, from, to)
+			}
+		}
+		for j := range docs {
+			if docs[j].Text() != docs[0].Text() {
+				t.Fatalf("Trial %d: doc %d='%s', doc 0='%s'", i, j, docs[j].Text(), docs[0].Text())
+			}
+		}
+	}
+}
+
+func TestClientConflict(t *testing.T) {
+	// Two replicas editing with the same client
+	doc1 := NewDocWithClient(1)
+	doc2 := NewDocWithClient(1)
+	doc1.Insert(0, "abc")
+	doc2.Insert(0, "xyz")
+	err := doc1.ApplyUpdate(doc2.EncodeState())
+	if !errors.Is(err, ErrClientConflict) {
+		t.Errorf("Unexpected error for a reused client: %v", err)
+	}
+	if doc1.Text() != "abc" {
+		t.Errorf("Unexpected content after a conflict: '%s'", doc1.Text())
+	}
+	// The same history received again is not a conflict
+	doc3 := NewDocWithClient(2)
+	syncDocs(t, doc1, doc3)
+	if err := doc3.ApplyUpdate(doc1.EncodeState()); err != nil {
+		t.Errorf("Unexpected error applying the same history: %v", err)
+	}
+}
+
+func TestClientChangedByRemoteEdits(t *testing.T) {
+	doc1 := NewDocWithClient(1)
+	doc1.Insert(0, "abc")
+	// A replica loading the state of its own client continues with a new client
+	doc2 := NewDocWithClient(1)
+	syncDocs(t, doc1, doc2)
+	if doc2.Client() == 1 {
+		t.Fatalf("The client has not changed after receiving edits made with it")
+	}
+	doc2.Insert(3, "d")
+	doc1.Insert(3, "e")
+	syncDocs(t, doc1, doc2)
+	syncDocs(t, doc2, doc1)
+	if doc1.Text() != doc2.Text() || len(doc1.Text()) != 5 {
+		t.Errorf("Unexpected content: doc1='%s', doc2='%s'", doc1.Text(), doc2.Text())
+	}
+	// Receiving edits of other clients keeps the client
+	if client := doc1.Client(); client != 1 {
+		t.Errorf("Unexpected client change to %d", client)
+	}
+}
+
+func TestPendingFuzzer(t *testing.T) {
+	const trials int64 = 100
+	for i := range trials {
+		rng := rand.New(rand.NewSource(i))
+		docs := []*Doc{NewDocWithClient(0), NewDocWithClient(1), NewDocWithClient(2)}
+		// Updates of every document, delivered to the others in a random order
+		inboxes := make([][][]byte, len(docs))
+		for j, doc := range docs {
+			doc.ObserveUpdates(func(update []byte, local bool) {
+				if !local {
+					return
+				}
+				for k := range docs {
+					if k != j {
+						inboxes[k] = append(inboxes[k], update)
+					}
+				}
+			})
+		}
+		deliver := func(j int, count int) {
+			for range min(count, len(inboxes[j])) {
+				k := rng.Intn(len(inboxes[j]))
+				update := inboxes[j][k]
+				inboxes[j] = append(inboxes[j][:k], inboxes[j][k+1:]...)
+				if err := docs[j].ApplyUpdate(update); err != nil {
+					t.Fatalf("Trial %d: unexpected error: %v", i, err)
+				}
+			}
+		}
+		for range 200 {
+			randomEdit(t, rng, docs[rng.Intn(len(docs))])
+			deliver(rng.Intn(len(docs)), rng.Intn(3))
+		}
+		for j := range docs {
+			deliver(j, len(inboxes[j]))
+			if len(docs[j].pending) > 0 {
+				t.Fatalf("Trial %d: doc %d has pending items after receiving every update", i, j)
+			}
+			if docs[j].Text() != docs[0].Text() {
+				t.Fatalf("Trial %d: doc %d='%s', doc 0='%s'", i, j, docs[j].Text(), docs[0].Text())
+			}
+		}
+	}
+}